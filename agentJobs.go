@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	agentJobResultsDesc = prometheus.NewDesc(
+		"azdo_agent_job_results_total",
+		"Total of the jobs of finished builds run by the agent, by result",
+		[]string{"pool", "agent", "result"},
+		nil,
+	)
+
+	agentRecentJobsDesc = prometheus.NewDesc(
+		"azdo_agent_recent_jobs",
+		"Number of jobs run by the agent that finished within the failure window",
+		[]string{"pool", "agent"},
+		nil,
+	)
+
+	agentFailureRatioDesc = prometheus.NewDesc(
+		"azdo_agent_job_failure_ratio",
+		"Ratio of the jobs run by the agent that finished within the failure window that failed",
+		[]string{"pool", "agent"},
+		nil,
+	)
+)
+
+// agentJobMetrics attribute the jobs of every finished build to the agent that ran them, from the
+// workerName of the job records of the build timeline, if that is turned on
+type agentJobMetrics struct {
+	enabled bool
+	results *counterSet
+
+	// window is how far back jobs count towards the failure ratio of an agent
+	window time.Duration
+	lock   sync.Mutex
+	recent map[string]*agentRecentJobs // By labelKey of pool and agent
+
+	// queuePools remembers the agent pool behind each queue, by labelKey of project and queue id
+	queuePools map[string]string
+}
+
+type agentRecentJobs struct {
+	pool  string
+	agent string
+	jobs  []agentJob
+}
+
+type agentJob struct {
+	finishTime time.Time
+	failed     bool
+}
+
+func newAgentJobMetrics(enabled bool, window time.Duration) *agentJobMetrics {
+	return &agentJobMetrics{
+		enabled:    enabled,
+		results:    newCounterSet(agentJobResultsDesc),
+		window:     window,
+		recent:     make(map[string]*agentRecentJobs),
+		queuePools: make(map[string]string),
+	}
+}
+
+// Observe attributes the jobs of the timeline of a finished build to the agents that ran them. pools
+// holds the agent pool behind each queue the jobs ran on.
+func (am *agentJobMetrics) Observe(build azdo.Build, timeline azdo.Timeline, pools map[int]string, now time.Time) {
+	for _, record := range timeline.Records {
+		// Jobs that were skipped or never assigned an agent have no worker
+		if record.Type != "Job" || record.WorkerName == "" || record.Result == "" {
+			continue
+		}
+
+		// A job can run on a pool of its own rather than the default queue of the build. Jobs whose queue
+		// couldn't be looked up are left out rather than attributed to the wrong pool.
+		pool := build.Queue.Pool.Name
+		if record.QueueId != 0 {
+			var ok bool
+			if pool, ok = pools[record.QueueId]; !ok {
+				continue
+			}
+		}
+		am.results.Add(1, pool, record.WorkerName, record.Result)
+
+		// Cancelled jobs say nothing about the health of the agent
+		if record.Result == "canceled" || record.Result == "abandoned" || record.FinishTime.IsZero() {
+			continue
+		}
+		am.add(pool, record.WorkerName, agentJob{finishTime: record.FinishTime, failed: record.Result == "failed"}, now)
+	}
+}
+
+// jobPools returns the agent pool behind each queue the jobs of the timeline ran on. Each queue is
+// only looked up the first time it is seen, a queue that no longer exists is left out.
+func (azc *azDoCollector) jobPools(ctx context.Context, project azdo.Project, build azdo.Build, timeline azdo.Timeline) (map[int]string, error) {
+	if build.Queue.Id != 0 && build.Queue.Pool.Name != "" {
+		azc.agentJobs.rememberPool(project.Name, build.Queue.Id, build.Queue.Pool.Name)
+	}
+
+	pools := make(map[int]string)
+	for _, record := range timeline.Records {
+		if record.Type != "Job" || record.QueueId == 0 {
+			continue
+		}
+		if _, ok := pools[record.QueueId]; ok {
+			continue
+		}
+
+		pool, ok := azc.agentJobs.poolOf(project.Name, record.QueueId)
+		if !ok {
+			queue, err := azc.AzDoClient.GetQueue(ctx, project.Name, record.QueueId)
+			if err != nil {
+				azc.recordError(project.Name, err)
+				if azdo.ErrorKindOf(err) == azdo.ErrorKindNotFound {
+					continue
+				}
+				return nil, err
+			}
+			pool = queue.Pool.Name
+			azc.agentJobs.rememberPool(project.Name, record.QueueId, pool)
+		}
+		pools[record.QueueId] = pool
+	}
+	return pools, nil
+}
+
+func (am *agentJobMetrics) poolOf(project string, queueId int) (string, bool) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	pool, ok := am.queuePools[labelKey([]string{project, strconv.Itoa(queueId)})]
+	return pool, ok
+}
+
+func (am *agentJobMetrics) rememberPool(project string, queueId int, pool string) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	am.queuePools[labelKey([]string{project, strconv.Itoa(queueId)})] = pool
+}
+
+func (am *agentJobMetrics) add(pool string, agent string, job agentJob, now time.Time) {
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	key := labelKey([]string{pool, agent})
+	recent, ok := am.recent[key]
+	if !ok {
+		recent = &agentRecentJobs{pool: pool, agent: agent}
+		am.recent[key] = recent
+	}
+	recent.jobs = append(recent.jobs, job)
+	am.evict(now)
+}
+
+// evict forgets the jobs that finished before the window, and the agents left without any
+func (am *agentJobMetrics) evict(now time.Time) {
+	for key, recent := range am.recent {
+		kept := recent.jobs[:0]
+		for _, job := range recent.jobs {
+			if now.Sub(job.finishTime) <= am.window {
+				kept = append(kept, job)
+			}
+		}
+		recent.jobs = kept
+
+		if len(recent.jobs) == 0 {
+			delete(am.recent, key)
+		}
+	}
+}
+
+func (am *agentJobMetrics) Collect(ch chan<- prometheus.Metric) {
+	am.results.Collect(ch)
+
+	am.lock.Lock()
+	defer am.lock.Unlock()
+
+	am.evict(time.Now())
+
+	keys := make([]string, 0, len(am.recent))
+	for key := range am.recent {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		recent := am.recent[key]
+
+		failed := 0
+		for _, job := range recent.jobs {
+			if job.failed {
+				failed++
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(agentRecentJobsDesc, prometheus.GaugeValue, float64(len(recent.jobs)), recent.pool, recent.agent)
+		ch <- prometheus.MustNewConstMetric(agentFailureRatioDesc, prometheus.GaugeValue, float64(failed)/float64(len(recent.jobs)), recent.pool, recent.agent)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var agentJobsNow = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestAgentJobMetricsObserve(t *testing.T) {
+	build := azdo.Build{Id: 1, Queue: azdo.Queue{Id: 10, Name: "Default", Pool: azdo.Pool{Name: "default-pool"}}}
+	timeline := azdo.Timeline{Records: []azdo.TimelineRecord{
+		{Type: "Job", WorkerName: "agent-1", Result: "succeeded", QueueId: 10, FinishTime: agentJobsNow},
+		{Type: "Job", WorkerName: "gpu-1", Result: "failed", QueueId: 20, FinishTime: agentJobsNow},
+		{Type: "Job", WorkerName: "agent-2", Result: "failed", FinishTime: agentJobsNow},             // No queue, the default of the build
+		{Type: "Job", WorkerName: "lost-1", Result: "failed", QueueId: 30, FinishTime: agentJobsNow}, // Queue couldn't be looked up
+		{Type: "Job", Result: "skipped"},
+	}}
+	pools := map[int]string{10: "default-pool", 20: "gpu-pool"}
+
+	am := newAgentJobMetrics(true, time.Hour)
+	am.Observe(build, timeline, pools, agentJobsNow)
+
+	got := map[string]float64{}
+	for _, value := range am.results.snapshot() {
+		got[strings.Join(value.LabelValues, "/")] = value.Value
+	}
+	want := map[string]float64{
+		"default-pool/agent-1/succeeded": 1,
+		"gpu-pool/gpu-1/failed":          1,
+		"default-pool/agent-2/failed":    1,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got job results %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("got job results %v, want %v", got, want)
+		}
+	}
+}
+
+func TestJobPools(t *testing.T) {
+	var lookups atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_apis/distributedtask/queues/20"):
+			fmt.Fprint(w, `{"id": 20, "name": "GPU", "pool": {"id": 5, "name": "gpu-pool"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	azc := newAzDoCollector(azDoConfig{
+		AzDoClient:         azdo.AzDoClient{Client: server.Client(), Name: "test", Address: server.URL},
+		AgentJobs:          true,
+		AgentFailureWindow: time.Hour,
+	}, nil, nil, time.Minute)
+
+	project := azdo.Project{Name: "project"}
+	build := azdo.Build{Id: 1, Queue: azdo.Queue{Id: 10, Name: "Default", Pool: azdo.Pool{Name: "default-pool"}}}
+	timeline := azdo.Timeline{Records: []azdo.TimelineRecord{
+		{Type: "Job", QueueId: 10},
+		{Type: "Job", QueueId: 20},
+		{Type: "Job", QueueId: 20},
+		{Type: "Job", QueueId: 30},
+		{Type: "Task", QueueId: 40},
+	}}
+
+	for poll := 1; poll <= 2; poll++ {
+		pools, err := azc.jobPools(t.Context(), project, build, timeline)
+		if err != nil {
+			t.Fatalf("poll %d jobPools returned an error: %v", poll, err)
+		}
+
+		want := map[int]string{10: "default-pool", 20: "gpu-pool"}
+		if len(pools) != len(want) || pools[10] != want[10] || pools[20] != want[20] {
+			t.Errorf("poll %d got pools %v, want %v", poll, pools, want)
+		}
+	}
+
+	// The default queue of the build is known without a lookup and the pool of a queue is remembered,
+	// only the queue that no longer exists is looked up again
+	if got := lookups.Load(); got != 3 {
+		t.Errorf("made %d queue lookups, want 3", got)
+	}
+}
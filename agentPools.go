@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	poolAgentsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_agents",
+		"Number of agents registered in the pool",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolOnlineAgentsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_online_agents",
+		"Number of agents of the pool that are online",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolOfflineAgentsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_offline_agents",
+		"Number of agents of the pool that are offline",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolEnabledAgentsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_enabled_agents",
+		"Number of agents of the pool that are enabled",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolBusyAgentsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_busy_agents",
+		"Number of agents of the pool running a job",
+		[]string{"pool"},
+		nil,
+	)
+
+	agentInfoDesc = prometheus.NewDesc(
+		"azdo_agent_info",
+		"Information about an agent, always 1",
+		[]string{"pool", "agent", "os", "version"},
+		nil,
+	)
+
+	poolQueuedJobsDesc = prometheus.NewDesc(
+		"azdo_agent_pool_queued_jobs",
+		"Number of jobs waiting to be assigned an agent of the pool",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolOldestQueuedJobDesc = prometheus.NewDesc(
+		"azdo_agent_pool_oldest_queued_job_age_seconds",
+		"Time the oldest job waiting for an agent of the pool has been queued, 0 if none are waiting",
+		[]string{"pool"},
+		nil,
+	)
+
+	poolJobWaitDesc = prometheus.NewDesc(
+		"azdo_agent_pool_job_wait_seconds",
+		"Time jobs waited from being queued to being assigned an agent of the pool",
+		[]string{"pool"},
+		nil,
+	)
+)
+
+// Number of recently completed job requests retrieved with the queued and running ones, so that
+// the wait of jobs assigned an agent between polls is still observed
+const completedJobRequestCount = 200
+
+// scrapeAgentPools retrieves the agents and job requests of every pool, calculating the capacity
+// and queue of each
+func (azc *azDoCollector) scrapeAgentPools(ctx context.Context, projects []azdo.Project) []prometheus.Metric {
+	pools, err := azc.AzDoClient.GetPools(ctx)
+	if err != nil {
+		azc.recordPoolError("", err)
+		return nil
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	metrics := []prometheus.Metric{}
+
+	for _, pool := range pools {
+		p := pool
+
+		if azc.agentPools {
+			wg.Add(1)
+			azc.pool.submit("pool/"+p.Name, func() {
+				defer wg.Done()
+
+				agents, err := azc.AzDoClient.GetAgents(ctx, p.Id)
+				if err != nil {
+					azc.recordPoolError(p.Name, err)
+					return
+				}
+
+				poolMetrics := calculateAgentPoolMetrics(p, agents)
+
+				lock.Lock()
+				metrics = append(metrics, poolMetrics...)
+				lock.Unlock()
+			})
+		}
+
+		if azc.jobRequests {
+			wg.Add(1)
+			azc.pool.submit("pool/"+p.Name, func() {
+				defer wg.Done()
+
+				requests, err := azc.AzDoClient.GetJobRequests(ctx, p.Id, completedJobRequestCount)
+				if err != nil {
+					azc.recordPoolError(p.Name, err)
+					return
+				}
+
+				poolMetrics := azc.calculateJobRequestMetrics(p, requests, time.Now())
+
+				lock.Lock()
+				metrics = append(metrics, poolMetrics...)
+				lock.Unlock()
+			})
+		}
+	}
+
+	wg.Wait()
+	return metrics
+}
+
+func calculateAgentPoolMetrics(pool azdo.Pool, agents []azdo.Agent) []prometheus.Metric {
+
+	online, offline, enabled, busy := 0, 0, 0, 0
+	promMetrics := []prometheus.Metric{}
+
+	for _, agent := range agents {
+		if strings.EqualFold(agent.Status, "online") {
+			online++
+		} else {
+			offline++
+		}
+		if agent.Enabled {
+			enabled++
+		}
+		if agent.AssignedRequest != nil {
+			busy++
+		}
+
+		promMetrics = append(promMetrics, prometheus.MustNewConstMetric(
+			agentInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			pool.Name,
+			agent.Name,
+			agentOS(agent),
+			agentVersion(agent),
+		))
+	}
+
+	return append(promMetrics,
+		prometheus.MustNewConstMetric(poolAgentsDesc, prometheus.GaugeValue, float64(len(agents)), pool.Name),
+		prometheus.MustNewConstMetric(poolOnlineAgentsDesc, prometheus.GaugeValue, float64(online), pool.Name),
+		prometheus.MustNewConstMetric(poolOfflineAgentsDesc, prometheus.GaugeValue, float64(offline), pool.Name),
+		prometheus.MustNewConstMetric(poolEnabledAgentsDesc, prometheus.GaugeValue, float64(enabled), pool.Name),
+		prometheus.MustNewConstMetric(poolBusyAgentsDesc, prometheus.GaugeValue, float64(busy), pool.Name),
+	)
+}
+
+// calculateJobRequestMetrics calculates the queue of the pool and observes the wait of each job
+// assigned an agent since the last poll. The jobs returned by the first poll of a pool were assigned
+// before the exporter started, so they only seed the ledger.
+func (azc *azDoCollector) calculateJobRequestMetrics(pool azdo.Pool, requests []azdo.JobRequest, now time.Time) []prometheus.Metric {
+
+	scope := "pool/" + pool.Name
+	firstPoll := azc.jobRequestLedger.firstPoll(scope)
+
+	queued := 0
+	var oldestQueueTime time.Time
+
+	for _, request := range requests {
+		if request.AssignTime.IsZero() {
+			// Requests cancelled before they were assigned finish without ever being assigned
+			if request.FinishTime.IsZero() {
+				queued++
+				if oldestQueueTime.IsZero() || request.QueueTime.Before(oldestQueueTime) {
+					oldestQueueTime = request.QueueTime
+				}
+			}
+			continue
+		}
+
+		if azc.jobRequestLedger.admitOnce(scope, request.RequestId, request.AssignTime, now) && !firstPoll {
+			azc.jobWaitTimes.Observe(request.AssignTime.Sub(request.QueueTime).Seconds(), pool.Name)
+		}
+	}
+
+	oldestAge := 0.0
+	if !oldestQueueTime.IsZero() {
+		oldestAge = now.Sub(oldestQueueTime).Seconds()
+	}
+
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(poolQueuedJobsDesc, prometheus.GaugeValue, float64(queued), pool.Name),
+		prometheus.MustNewConstMetric(poolOldestQueuedJobDesc, prometheus.GaugeValue, oldestAge, pool.Name),
+	}
+}
+
+// agentOS returns the operating system of the agent from its capabilities
+func agentOS(agent azdo.Agent) string {
+	if os, ok := agent.SystemCapabilities["Agent.OS"]; ok {
+		return os
+	}
+	return agent.OsDescription
+}
+
+// agentVersion returns the version of the agent software from its capabilities
+func agentVersion(agent azdo.Agent) string {
+	if version, ok := agent.SystemCapabilities["Agent.Version"]; ok {
+		return version
+	}
+	return agent.Version
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestCalculateJobRequestMetricsFirstPoll(t *testing.T) {
+	azc := newAzDoCollector(azDoConfig{LedgerTTL: 2 * time.Hour}, nil, nil, time.Minute)
+	pool := azdo.Pool{Id: 1, Name: "default"}
+
+	assigned := func(id int, assignedAt time.Duration) azdo.JobRequest {
+		return azdo.JobRequest{RequestId: id, QueueTime: ledgerStart, AssignTime: ledgerStart.Add(assignedAt)}
+	}
+	observed := func() uint64 {
+		count := uint64(0)
+		for _, value := range azc.jobWaitTimes.snapshot() {
+			count += value.Count
+		}
+		return count
+	}
+
+	// The jobs assigned before the exporter started only seed the ledger
+	requests := []azdo.JobRequest{assigned(1, time.Minute), assigned(2, 2*time.Minute)}
+	azc.calculateJobRequestMetrics(pool, requests, ledgerStart.Add(5*time.Minute))
+	if got := observed(); got != 0 {
+		t.Errorf("first poll observed %d waits, want 0", got)
+	}
+
+	// Only the job assigned since is observed by the next poll
+	requests = append(requests, assigned(3, 6*time.Minute))
+	azc.calculateJobRequestMetrics(pool, requests, ledgerStart.Add(10*time.Minute))
+	if got := observed(); got != 1 {
+		t.Errorf("second poll observed %d waits, want 1", got)
+	}
+
+	// A pool with jobs restored from the saved state is counted from its first poll
+	restored := azdo.Pool{Id: 2, Name: "restored"}
+	azc.jobRequestLedger.restore(map[string]map[int]ledgerEntry{"pool/restored": {4: {FinishTime: ledgerStart, LastSeen: ledgerStart}}})
+	azc.calculateJobRequestMetrics(restored, []azdo.JobRequest{assigned(5, time.Minute)}, ledgerStart.Add(10*time.Minute))
+	if got := observed(); got != 2 {
+		t.Errorf("first poll of a restored pool observed %d waits in all, want 2", got)
+	}
+}
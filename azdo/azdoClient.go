@@ -1,10 +1,13 @@
 package azdo
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,17 +16,26 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const defaultApiVersion = "6.0"
+
 type AzDoClient struct {
 	Client            *http.Client
 	ApiVersion        string
 	Name              string
 	Address           string
 	DefaultCollection string
-	Projects		  []string
+	Projects          []string
 	AccessToken       string
+	PageSize          int       // Number of items requested per page with $top
+	MaxPages          int       // Maximum number of pages followed per list call
+	MaxPagesPerPoll   int       // Maximum number of pages followed by continuation token across every list call of a poll
+	Definitions       []int     // Only request builds of these definition ids, all definitions if empty
+	RequestsPerSecond float64   // Maximum rate of requests to the server, unlimited if not set
+	ReleaseAddress    string    // Base url of the release management api, derived from Address if not set
+	Throttle          *Throttle `toml:"-"`
 }
 
-func (az *AzDoClient) GetProjects() ([]Project, error) {
+func (az *AzDoClient) GetProjects(ctx context.Context) ([]Project, error) {
 	log.WithFields(log.Fields{"serverName": az.Name}).Info("Get Projects")
 
 	if len(az.Projects) != 0 {
@@ -36,128 +48,160 @@ func (az *AzDoClient) GetProjects() ([]Project, error) {
 		return projects, nil
 	}
 
-	var url = az.buildURL("_apis/projects?api-version=")
-
-	if len(az.ApiVersion) != 0 {
-		url = url + az.ApiVersion
-	} else {
-		url = url + "6.0"
-	}
-
-	req, err := http.NewRequest("GET", url, nil)
-
-	req.SetBasicAuth("", az.AccessToken)
-
-	responseData, err := az.makeRequest(req)
-
-	if err != nil {
-		return []Project{}, err
-	}
-
-	are := projectResponseEnvelope{}
-	err = json.Unmarshal(responseData, &are)
+	projects, err := getList[Project](ctx, az, newEndpoint("_apis/projects"), nil)
 	if err != nil {
 		return []Project{}, err
 	}
 
-	return are.Projects, nil
+	return projects, nil
 }
 
-func (az *AzDoClient) GetBuilds(projectName string, after time.Time) (finishedBuilds, currentBuilds []Build, err error) {
+// GetBuilds returns the builds of a project that have finished since the after time and all builds
+// that are currently queued or running. If after is zero no finished builds are requested.
+//
+// Finished builds are requested oldest first, so if the list is cut short by the page limits it is
+// the newest builds that are dropped, and they are returned by the next call after the watermark.
+func (az *AzDoClient) GetBuilds(ctx context.Context, projectName string, after time.Time) (finishedBuilds, currentBuilds []Build, err error) {
 
 	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName}).Info("Get Builds")
 
-		var url = az.buildURL(projectName + "/_apis/build/builds?api-version=")
-		
-		if len(az.ApiVersion) != 0 {
-			url = url + az.ApiVersion
-		} else {
-			url = url + "6.0"
+	if !after.IsZero() {
+		query := az.buildsQuery()
+		query.Set("statusFilter", "completed")
+		query.Set("queryOrder", "finishTimeAscending")
+		query.Set("minTime", after.UTC().Format(time.RFC3339Nano))
+
+		builds, err := getList[Build](ctx, az, newEndpoint("{project}/_apis/build/builds", projectName), query)
+		if err != nil {
+			return []Build{}, []Build{}, err
 		}
 
-		log.WithFields(log.Fields{"serverName": az.Name, "project": projectName}).Info(url)
+		// minTime is inclusive, so drop the builds that finished exactly on the boundary
+		for _, build := range builds {
+			if build.FinishTime.After(after) {
+				finishedBuilds = append(finishedBuilds, build)
+			}
+		}
+	}
 
-		req, err := http.NewRequest("GET", url, nil)
+	query := az.buildsQuery()
+	query.Set("statusFilter", "notStarted,inProgress,cancelling,postponed")
 
-		req.SetBasicAuth("", az.AccessToken)
+	currentBuilds, err = getList[Build](ctx, az, newEndpoint("{project}/_apis/build/builds", projectName), query)
+	if err != nil {
+		return []Build{}, []Build{}, err
+	}
 
-		responseData, err := az.makeRequest(req)
+	return finishedBuilds, currentBuilds, nil
+}
 
-		if err != nil {
-			log.Error(err)
-			return []Build{},[]Build{}, err
+// buildsQuery returns the query parameters shared by every builds request
+func (az *AzDoClient) buildsQuery() url.Values {
+	query := url.Values{}
+	if len(az.Definitions) != 0 {
+		definitions := make([]string, 0, len(az.Definitions))
+		for _, id := range az.Definitions {
+			definitions = append(definitions, strconv.Itoa(id))
 		}
+		query.Set("definitions", strings.Join(definitions, ","))
+	}
+	return query
+}
 
-		are := buildResponseEnvelope{}
-		err = json.Unmarshal(responseData, &are)
-		if err != nil {
-			log.Error(err)
-			return []Build{},[]Build{}, err
-		}
+// get makes an authenticated GET request against the url, returning the body and headers of the response.
+// The route is the template the url was built from.
+func (az *AzDoClient) get(ctx context.Context, route string, url string) ([]byte, http.Header, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "URL": url}).Debug("GET")
 
-		var builds = are.Builds
-		for _, job := range builds {
-			if job.FinishTime.IsZero() {
-				currentBuilds = append(currentBuilds, job)
-				continue
-			}
-	
-			if !after.IsZero() {
-				if job.FinishTime.After(after) {
-					finishedBuilds = append(finishedBuilds, job)
-				}
-			}
-		}
-	
-		return finishedBuilds, currentBuilds, nil
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return []byte{}, nil, err
+	}
+
+	req.SetBasicAuth("", az.AccessToken)
+
+	return az.makeRequest(req, route)
 }
 
-func (az *AzDoClient) makeRequest(req *http.Request) ([]byte, error) {
+func (az *AzDoClient) makeRequest(req *http.Request, route string) ([]byte, http.Header, error) {
 
 	var (
 		responseData []byte
+		header       http.Header
 		err          error
+		attempt      int
 	)
 
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = 30 * time.Second
+	ctx := req.Context()
 
 	notify := func(err error, ti time.Duration) {
 		log.WithFields(log.Fields{"serverName": az.Name, "URL": req.URL, "error": err}).Warning("Retrying HTTP request")
 	}
 
 	retry := func() error {
-		responseData, err = az.makeHTTPRequest(req)
+		if az.Throttle != nil {
+			if err := az.Throttle.wait(ctx); err != nil {
+				return backoff.Permanent(&RequestError{Kind: ErrorKindTimeout, URL: req.URL.String(), Err: err})
+			}
+		}
+
+		attempt++
+		responseData, header, err = az.makeHTTPRequest(req, route, attempt)
+
+		var requestError *RequestError
+		if errors.As(err, &requestError) && !requestError.Retryable() {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
 
-	e := backoff.RetryNotify(retry, b, notify)
+	e := backoff.RetryNotify(retry, backoff.WithContext(b, ctx), notify)
 	if e != nil {
-		return []byte{}, e
+		return []byte{}, nil, e
 	}
 
-	return responseData, nil
+	return responseData, header, nil
 }
 
-func (az *AzDoClient) makeHTTPRequest(req *http.Request) ([]byte, error) {
+func (az *AzDoClient) makeHTTPRequest(req *http.Request, route string, attempt int) ([]byte, http.Header, error) {
+
+	requestsInFlight.WithLabelValues(az.Name).Inc()
+	defer requestsInFlight.WithLabelValues(az.Name).Dec()
 
 	// Send request
+	start := time.Now()
 	resp, err := az.Client.Do(req)
 	if err != nil {
-		return []byte{}, fmt.Errorf("Call to %v failed: %v", req.URL, err)
+		az.observeRequest(route, "error", attempt, time.Since(start))
+		if req.Context().Err() != nil {
+			return []byte{}, nil, &RequestError{Kind: ErrorKindTimeout, URL: req.URL.String(), Err: err}
+		}
+		return []byte{}, nil, &RequestError{Kind: ErrorKindTransport, URL: req.URL.String(), Err: err}
 	}
 	defer resp.Body.Close()
 	log.WithFields(log.Fields{"serverName": az.Name, "URL": req.URL, "StatusCode": resp.StatusCode}).Trace("Made HTTP request")
 
+	if az.Throttle != nil {
+		az.Throttle.observe(resp.Header)
+	}
+
 	// Read body of response
 	responseData, err := ioutil.ReadAll(resp.Body)
+	az.observeRequest(route, strconv.Itoa(resp.StatusCode), attempt, time.Since(start))
+	responseSize.WithLabelValues(az.Name, route).Observe(float64(len(responseData)))
 	if err != nil {
-		return []byte{}, fmt.Errorf("Failed to read body %v", err)
+		return []byte{}, nil, &RequestError{Kind: ErrorKindTransport, StatusCode: resp.StatusCode, URL: req.URL.String(), Err: fmt.Errorf("Failed to read body %v", err)}
 	}
 
 	log.Debug(string(responseData))
 
-	return responseData, nil
+	if kind, failed := errorKindForStatus(resp.StatusCode); failed {
+		return []byte{}, nil, &RequestError{Kind: kind, StatusCode: resp.StatusCode, URL: req.URL.String(), Err: errors.New(http.StatusText(resp.StatusCode))}
+	}
+
+	return responseData, resp.Header, nil
 }
 
 func (az *AzDoClient) buildURL(url string) string {
@@ -174,3 +218,45 @@ func (az *AzDoClient) buildURL(url string) string {
 
 	return baseURL + url
 }
+
+// releaseURL builds the full url of a path of the release management api. AzDO Services serves it
+// from its own vsrm host, AzDO Server serves it alongside everything else.
+func (az *AzDoClient) releaseURL(url string) string {
+	if !strings.HasPrefix(url, "/") {
+		url = "/" + url
+	}
+
+	if az.ReleaseAddress != "" {
+		return strings.TrimSuffix(az.ReleaseAddress, "/") + url
+	}
+
+	switch {
+	case strings.HasPrefix(az.Address, "https://dev.azure.com/"):
+		return "https://vsrm.dev.azure.com/" + strings.TrimPrefix(az.Address, "https://dev.azure.com/") + url
+	case strings.HasPrefix(az.Address, "https://") && strings.HasSuffix(az.Address, ".visualstudio.com"):
+		return strings.TrimSuffix(az.Address, ".visualstudio.com") + ".vsrm.visualstudio.com" + url
+	}
+	return az.buildURL(url)
+}
+
+// apiURL builds the full url for an endpoint, adding the api-version to the query
+func (az *AzDoClient) apiURL(ep endpoint, query url.Values) string {
+	values := url.Values{}
+	for k, v := range query {
+		values[k] = v
+	}
+
+	apiVersion := defaultApiVersion
+	if len(az.ApiVersion) != 0 {
+		apiVersion = az.ApiVersion
+	}
+	if ep.Preview != 0 {
+		apiVersion += "-preview." + strconv.Itoa(ep.Preview)
+	}
+	values.Set("api-version", apiVersion)
+
+	if ep.Release {
+		return az.releaseURL(ep.Path) + "?" + values.Encode()
+	}
+	return az.buildURL(ep.Path) + "?" + values.Encode()
+}
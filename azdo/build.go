@@ -3,11 +3,6 @@ import (
 	"time"
 )
 
-type buildResponseEnvelope struct {
-	Count int `json:"count"`
-	Builds  []Build `json:"value"`
-}
-
 type Build struct {
 	Id   int    `json:"id"`
 	Number string `json:"buildNumber"`
@@ -18,6 +13,27 @@ type Build struct {
 	StartTime time.Time `json:"startTime"`
 	FinishTime time.Time `json:"finishTime"`
 	Definition Definition `json:"definition"`
+	Queue Queue `json:"queue"`
+	SourceBranch string `json:"sourceBranch"`
+	SourceVersion string `json:"sourceVersion"`
+	Reason string `json:"reason"`
+	RequestedFor Identity `json:"requestedFor"`
+	Tags []string `json:"tags"`
+	TriggerInfo map[string]string `json:"triggerInfo"`
+}
+
+// Identity is the user or service a build was run for
+type Identity struct {
+	Id string `json:"id"`
+	DisplayName string `json:"displayName"`
+	UniqueName string `json:"uniqueName"`
+}
+
+// Queue is the agent queue a build was sent to, and the agent pool behind it
+type Queue struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+	Pool Pool `json:"pool"`
 }
 
 type Definition struct {
@@ -0,0 +1,42 @@
+package azdo
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Change is a commit, or other change to the source, built by a build
+type Change struct {
+	Id        string       `json:"id"`
+	Type      string       `json:"type"`
+	Message   string       `json:"message"`
+	Author    ChangeAuthor `json:"author"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+type ChangeAuthor struct {
+	DisplayName string `json:"displayName"`
+	UniqueName  string `json:"uniqueName"`
+}
+
+// GetBuildChanges returns the changes built by a build that weren't built by the previous build of its definition
+func (az *AzDoClient) GetBuildChanges(ctx context.Context, projectName string, buildId int) ([]Change, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "buildId": buildId}).Debug("Get Build Changes")
+
+	return getList[Change](ctx, az, newEndpoint("{project}/_apis/build/builds/{buildId}/changes", projectName, strconv.Itoa(buildId)), nil)
+}
+
+// GetChangesBetweenBuilds returns the changes built by the builds after fromBuildId, up to and including toBuildId
+func (az *AzDoClient) GetChangesBetweenBuilds(ctx context.Context, projectName string, fromBuildId int, toBuildId int) ([]Change, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "fromBuildId": fromBuildId, "toBuildId": toBuildId}).Debug("Get Changes Between Builds")
+
+	query := url.Values{}
+	query.Set("fromBuildId", strconv.Itoa(fromBuildId))
+	query.Set("toBuildId", strconv.Itoa(toBuildId))
+
+	return getList[Change](ctx, az, newEndpoint("{project}/_apis/build/changes", projectName).preview(2), query)
+}
@@ -0,0 +1,37 @@
+package azdo
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CodeCoverageSummary is the code coverage of a build, for each flavour and platform it was built for
+type CodeCoverageSummary struct {
+	CoverageData []CodeCoverageData `json:"coverageData"`
+}
+
+type CodeCoverageData struct {
+	BuildFlavor   string                  `json:"buildFlavor"`
+	BuildPlatform string                  `json:"buildPlatform"`
+	CoverageStats []CodeCoverageStatistic `json:"coverageStats"`
+}
+
+// CodeCoverageStatistic is the coverage of one kind of thing, such as Lines or Branches
+type CodeCoverageStatistic struct {
+	Label   string `json:"label"`
+	Covered int    `json:"covered"`
+	Total   int    `json:"total"`
+}
+
+// GetCodeCoverage returns the summary of the code coverage published by a build
+func (az *AzDoClient) GetCodeCoverage(ctx context.Context, projectName string, buildId int) (CodeCoverageSummary, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "buildId": buildId}).Debug("Get Code Coverage")
+
+	query := url.Values{}
+	query.Set("buildId", strconv.Itoa(buildId))
+
+	return getObject[CodeCoverageSummary](ctx, az, newEndpoint("{project}/_apis/test/codecoverage", projectName).preview(1), query)
+}
@@ -0,0 +1,49 @@
+package azdo
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment is a YAML pipeline environment deployments are made to
+type Environment struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// DeploymentRecord is a deployment job of a pipeline run that targeted an environment
+type DeploymentRecord struct {
+	Id            int        `json:"id"`
+	EnvironmentId int        `json:"environmentId"`
+	StageName     string     `json:"stageName"`
+	JobName       string     `json:"jobName"`
+	Result        string     `json:"result"`
+	QueueTime     time.Time  `json:"queueTime"`
+	StartTime     time.Time  `json:"startTime"`
+	FinishTime    time.Time  `json:"finishTime"`
+	Definition    Definition `json:"definition"`
+	Owner         RunOwner   `json:"owner"`
+}
+
+// RunOwner is the pipeline run a deployment record belongs to
+type RunOwner struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// GetEnvironments returns the environments of a project
+func (az *AzDoClient) GetEnvironments(ctx context.Context, projectName string) ([]Environment, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName}).Info("Get Environments")
+
+	return getList[Environment](ctx, az, newEndpoint("{project}/_apis/distributedtask/environments", projectName).preview(1), nil)
+}
+
+// GetDeploymentRecords returns up to count of the most recent deployments to an environment
+func (az *AzDoClient) GetDeploymentRecords(ctx context.Context, projectName string, environmentId int, count int) ([]DeploymentRecord, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "environmentId": environmentId}).Debug("Get Deployment Records")
+
+	return getFirstPage[DeploymentRecord](ctx, az, newEndpoint("{project}/_apis/distributedtask/environments/{environmentId}/environmentdeploymentrecords", projectName, strconv.Itoa(environmentId)).preview(1), nil, count)
+}
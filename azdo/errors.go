@@ -0,0 +1,79 @@
+package azdo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorKind classifies why a request to Azure DevOps failed
+type ErrorKind string
+
+const (
+	ErrorKindAuthentication ErrorKind = "authentication" // Access token missing, invalid or expired
+	ErrorKindAuthorization  ErrorKind = "authorization"  // Access token lacks the permissions needed
+	ErrorKindNotFound       ErrorKind = "not_found"      // Resource (e.g. project) does not exist
+	ErrorKindThrottled      ErrorKind = "throttled"      // Rate limited by Azure DevOps
+	ErrorKindServer         ErrorKind = "server"         // 5xx returned by Azure DevOps
+	ErrorKindDecode         ErrorKind = "decode"         // Response body could not be decoded
+	ErrorKindTransport      ErrorKind = "transport"      // Request never got a response
+	ErrorKindTimeout        ErrorKind = "timeout"        // Deadline of the request or scrape passed
+	ErrorKindUnexpected     ErrorKind = "unexpected"     // Any other failure
+)
+
+// RequestError is returned by the client for every failed request to Azure DevOps
+type RequestError struct {
+	Kind       ErrorKind
+	StatusCode int
+	URL        string
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%v error calling %v (status %v): %v", e.Kind, e.URL, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%v error calling %v: %v", e.Kind, e.URL, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports if the request may succeed if it is made again
+func (e *RequestError) Retryable() bool {
+	switch e.Kind {
+	case ErrorKindThrottled, ErrorKindServer, ErrorKindTransport:
+		return true
+	}
+	return false
+}
+
+// ErrorKindOf returns the kind of a RequestError anywhere in the chain of err
+func ErrorKindOf(err error) ErrorKind {
+	var requestError *RequestError
+	if errors.As(err, &requestError) {
+		return requestError.Kind
+	}
+	return ErrorKindUnexpected
+}
+
+// errorKindForStatus maps a http status code to the kind of error, returning false if the status is a success
+func errorKindForStatus(statusCode int) (ErrorKind, bool) {
+	switch {
+	// AzDO answers an invalid access token with a 203 and a sign-in page rather than a 401
+	case statusCode == http.StatusNonAuthoritativeInfo, statusCode == http.StatusUnauthorized:
+		return ErrorKindAuthentication, true
+	case statusCode == http.StatusForbidden:
+		return ErrorKindAuthorization, true
+	case statusCode == http.StatusNotFound:
+		return ErrorKindNotFound, true
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorKindThrottled, true
+	case statusCode >= 500:
+		return ErrorKindServer, true
+	case statusCode >= 200 && statusCode < 300:
+		return "", false
+	}
+	return ErrorKindUnexpected, true
+}
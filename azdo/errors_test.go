@@ -0,0 +1,100 @@
+package azdo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int  // Status of the first response, every later response succeeds
+		dropConn     bool // Close the connection on the first request instead of responding
+		wantKind     ErrorKind
+		wantRequests int
+	}{
+		{name: "sign-in page", status: http.StatusNonAuthoritativeInfo, wantKind: ErrorKindAuthentication, wantRequests: 1},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantKind: ErrorKindAuthentication, wantRequests: 1},
+		{name: "forbidden", status: http.StatusForbidden, wantKind: ErrorKindAuthorization, wantRequests: 1},
+		{name: "not found", status: http.StatusNotFound, wantKind: ErrorKindNotFound, wantRequests: 1},
+		{name: "bad request", status: http.StatusBadRequest, wantKind: ErrorKindUnexpected, wantRequests: 1},
+		{name: "throttled", status: http.StatusTooManyRequests, wantRequests: 2},
+		{name: "server error", status: http.StatusInternalServerError, wantRequests: 2},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantRequests: 2},
+		{name: "transport error", dropConn: true, wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) > 1 {
+					w.Write([]byte(`{}`))
+					return
+				}
+				if tt.dropConn {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			az := &AzDoClient{Client: server.Client(), Name: "test", Address: server.URL}
+			_, _, err := az.get(context.Background(), "_apis/test", server.URL+"/_apis/test")
+
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Errorf("got error %v, want the retry to succeed", err)
+				}
+			} else if kind := ErrorKindOf(err); kind != tt.wantKind {
+				t.Errorf("got error kind %q (%v), want %q", kind, err, tt.wantKind)
+			}
+
+			if got := int(requests.Load()); got != tt.wantRequests {
+				t.Errorf("made %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestErrorKindForStatus(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantKind      ErrorKind
+		wantFailed    bool
+		wantRetryable bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusNonAuthoritativeInfo, wantKind: ErrorKindAuthentication, wantFailed: true},
+		{status: http.StatusUnauthorized, wantKind: ErrorKindAuthentication, wantFailed: true},
+		{status: http.StatusForbidden, wantKind: ErrorKindAuthorization, wantFailed: true},
+		{status: http.StatusNotFound, wantKind: ErrorKindNotFound, wantFailed: true},
+		{status: http.StatusConflict, wantKind: ErrorKindUnexpected, wantFailed: true},
+		{status: http.StatusTooManyRequests, wantKind: ErrorKindThrottled, wantFailed: true, wantRetryable: true},
+		{status: http.StatusInternalServerError, wantKind: ErrorKindServer, wantFailed: true, wantRetryable: true},
+		{status: http.StatusGatewayTimeout, wantKind: ErrorKindServer, wantFailed: true, wantRetryable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			kind, failed := errorKindForStatus(tt.status)
+			if kind != tt.wantKind || failed != tt.wantFailed {
+				t.Errorf("got %q, %v, want %q, %v", kind, failed, tt.wantKind, tt.wantFailed)
+			}
+			if !failed {
+				return
+			}
+			if retryable := (&RequestError{Kind: kind}).Retryable(); retryable != tt.wantRetryable {
+				t.Errorf("retryable is %v, want %v", retryable, tt.wantRetryable)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package azdo
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "azdo_exporter_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests made to AzDO",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"name", "route", "code", "attempt"})
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "azdo_exporter_http_requests_total",
+		Help: "Total of HTTP requests made to AzDO",
+	}, []string{"name", "route", "code", "attempt"})
+
+	responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "azdo_exporter_http_response_size_bytes",
+		Help:    "Size of the bodies of the HTTP responses returned by AzDO",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 9), // 256B up to 16MB
+	}, []string{"name", "route"})
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azdo_exporter_http_requests_in_flight",
+		Help: "Number of HTTP requests to AzDO waiting for a response",
+	}, []string{"name"})
+)
+
+// Collectors returns the collectors instrumenting the requests made to AzDO, to be registered by the exporter
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{requestDuration, requestsTotal, responseSize, requestsInFlight}
+}
+
+// endpoint is an api path along with the route template it was built from. Metrics are labelled
+// with the route so that they don't have a series per project or build.
+type endpoint struct {
+	Route   string
+	Path    string
+	Release bool // Served by the release management api rather than the server address
+	Preview int  // Revision of a route that is still in preview, 0 if it isn't
+}
+
+// newEndpoint fills in the {placeholders} of the route, in order, with the escaped values
+func newEndpoint(route string, values ...string) endpoint {
+	path := route
+	for _, value := range values {
+		start := strings.Index(path, "{")
+		end := strings.Index(path, "}")
+		if start == -1 || end < start {
+			break
+		}
+		path = path[:start] + url.PathEscape(value) + path[end+1:]
+	}
+	return endpoint{Route: route, Path: path}
+}
+
+// newReleaseEndpoint is newEndpoint for the routes of the release management api
+func newReleaseEndpoint(route string, values ...string) endpoint {
+	ep := newEndpoint(route, values...)
+	ep.Release = true
+	return ep
+}
+
+// preview marks the endpoint as a route still in preview, requested with the revision of the preview
+func (ep endpoint) preview(revision int) endpoint {
+	ep.Preview = revision
+	return ep
+}
+
+// observeRequest records a request made to AzDO. code is the status code of the response,
+// or "error" if there was no response.
+func (az *AzDoClient) observeRequest(route string, code string, attempt int, duration time.Duration) {
+	labels := prometheus.Labels{"name": az.Name, "route": route, "code": code, "attempt": strconv.Itoa(attempt)}
+	requestDuration.With(labels).Observe(duration.Seconds())
+	requestsTotal.With(labels).Inc()
+}
@@ -0,0 +1,154 @@
+package azdo
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPageSize        = 1000
+	defaultMaxPages        = 20
+	defaultMaxPagesPerPoll = 1000
+
+	continuationTokenHeader = "X-Ms-Continuationtoken"
+)
+
+// listResponseEnvelope is the shape every AzDO list endpoint returns its values in
+type listResponseEnvelope[T any] struct {
+	Count int `json:"count"`
+	Value []T `json:"value"`
+}
+
+// pageBudget is the number of further pages the list calls sharing a context can still follow
+type pageBudget struct {
+	remaining atomic.Int64
+}
+
+type pageBudgetKey struct{}
+
+// WithPageBudget returns a context whose list calls follow at most MaxPagesPerPoll continuation
+// tokens between them. The first page of each list call is always requested.
+func (az *AzDoClient) WithPageBudget(ctx context.Context) context.Context {
+	budget := &pageBudget{}
+	budget.remaining.Store(int64(az.maxPagesPerPoll()))
+	return context.WithValue(ctx, pageBudgetKey{}, budget)
+}
+
+// takePage reports if another page can be followed, using up one page of the budget of the context
+func takePage(ctx context.Context) bool {
+	budget, ok := ctx.Value(pageBudgetKey{}).(*pageBudget)
+	if !ok {
+		return true
+	}
+	return budget.remaining.Add(-1) >= 0
+}
+
+// getList requests every page of a list endpoint, following the continuation token returned
+// by the server until there are no more pages, MaxPages has been reached or the page budget
+// of the context has been used up.
+func getList[T any](ctx context.Context, az *AzDoClient, ep endpoint, query url.Values) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("$top", strconv.Itoa(az.pageSize()))
+
+	var values []T
+	for page := 1; ; page++ {
+		pageURL := az.apiURL(ep, query)
+		responseData, header, err := az.get(ctx, ep.Route, pageURL)
+		if err != nil {
+			return values, err
+		}
+
+		envelope := listResponseEnvelope[T]{}
+		if err := json.Unmarshal(responseData, &envelope); err != nil {
+			return values, &RequestError{Kind: ErrorKindDecode, URL: pageURL, Err: err}
+		}
+		values = append(values, envelope.Value...)
+
+		continuationToken := header.Get(continuationTokenHeader)
+		if continuationToken == "" {
+			return values, nil
+		}
+
+		if page >= az.maxPages() {
+			log.WithFields(log.Fields{"serverName": az.Name, "path": ep.Path, "pages": page, "count": len(values)}).Warning("Maximum number of pages reached, remaining results have been dropped")
+			return values, nil
+		}
+
+		if !takePage(ctx) {
+			log.WithFields(log.Fields{"serverName": az.Name, "path": ep.Path, "pages": page, "count": len(values)}).Warning("Maximum number of pages per poll reached, remaining results have been dropped")
+			return values, nil
+		}
+
+		query.Set("continuationToken", continuationToken)
+	}
+}
+
+// getFirstPage requests only the first page of a list endpoint, of up to count values. Used for
+// lists that grow forever where only the most recent values are wanted.
+func getFirstPage[T any](ctx context.Context, az *AzDoClient, ep endpoint, query url.Values, count int) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("$top", strconv.Itoa(count))
+
+	pageURL := az.apiURL(ep, query)
+	responseData, _, err := az.get(ctx, ep.Route, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := listResponseEnvelope[T]{}
+	if err := json.Unmarshal(responseData, &envelope); err != nil {
+		return nil, &RequestError{Kind: ErrorKindDecode, URL: pageURL, Err: err}
+	}
+	return envelope.Value, nil
+}
+
+// getObject requests an endpoint that returns a single object rather than a list
+func getObject[T any](ctx context.Context, az *AzDoClient, ep endpoint, query url.Values) (T, error) {
+	var value T
+
+	objectURL := az.apiURL(ep, query)
+	responseData, _, err := az.get(ctx, ep.Route, objectURL)
+	if err != nil {
+		return value, err
+	}
+
+	// Some objects, such as the timeline of a build that never ran, come back empty
+	if len(responseData) == 0 {
+		return value, nil
+	}
+
+	if err := json.Unmarshal(responseData, &value); err != nil {
+		return value, &RequestError{Kind: ErrorKindDecode, URL: objectURL, Err: err}
+	}
+	return value, nil
+}
+
+func (az *AzDoClient) pageSize() int {
+	if az.PageSize > 0 {
+		return az.PageSize
+	}
+	return defaultPageSize
+}
+
+func (az *AzDoClient) maxPages() int {
+	if az.MaxPages > 0 {
+		return az.MaxPages
+	}
+	return defaultMaxPages
+}
+
+func (az *AzDoClient) maxPagesPerPoll() int {
+	if az.MaxPagesPerPoll > 0 {
+		return az.MaxPagesPerPoll
+	}
+	return defaultMaxPagesPerPoll
+}
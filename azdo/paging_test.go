@@ -0,0 +1,172 @@
+package azdo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// pagedServer serves pages of the values 1 to total, pageSize at a time, following the continuation
+// token it returns. It records the query of every request made to it.
+type pagedServer struct {
+	total int
+
+	lock    sync.Mutex
+	queries []map[string]string
+}
+
+func (ps *pagedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	ps.lock.Lock()
+	ps.queries = append(ps.queries, map[string]string{
+		"$top":              query.Get("$top"),
+		"continuationToken": query.Get("continuationToken"),
+		"api-version":       query.Get("api-version"),
+	})
+	ps.lock.Unlock()
+
+	top, _ := strconv.Atoi(query.Get("$top"))
+	start := 1
+	if token := query.Get("continuationToken"); token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := start + top - 1
+	if end > ps.total {
+		end = ps.total
+	}
+
+	values := ""
+	for i := start; i <= end; i++ {
+		if values != "" {
+			values += ","
+		}
+		values += strconv.Itoa(i)
+	}
+
+	if end < ps.total {
+		w.Header().Set("x-ms-continuationtoken", strconv.Itoa(end+1))
+	}
+	fmt.Fprintf(w, `{"count": %d, "value": [%s]}`, end-start+1, values)
+}
+
+func (ps *pagedServer) requests() []map[string]string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return append([]map[string]string{}, ps.queries...)
+}
+
+func newPagedClient(t *testing.T, server *pagedServer, pageSize int, maxPages int, maxPagesPerPoll int) *AzDoClient {
+	t.Helper()
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	return &AzDoClient{
+		Client:          ts.Client(),
+		Name:            "test",
+		Address:         ts.URL,
+		PageSize:        pageSize,
+		MaxPages:        maxPages,
+		MaxPagesPerPoll: maxPagesPerPoll,
+	}
+}
+
+func TestGetList(t *testing.T) {
+	tests := []struct {
+		name      string
+		total     int
+		pageSize  int
+		maxPages  int
+		wantCount int
+		wantPages int
+	}{
+		{name: "single page", total: 3, pageSize: 5, maxPages: 10, wantCount: 3, wantPages: 1},
+		{name: "every page followed", total: 12, pageSize: 5, maxPages: 10, wantCount: 12, wantPages: 3},
+		{name: "exact multiple of the page size", total: 10, pageSize: 5, maxPages: 10, wantCount: 10, wantPages: 2},
+		{name: "cut off at max pages", total: 50, pageSize: 5, maxPages: 3, wantCount: 15, wantPages: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &pagedServer{total: tt.total}
+			az := newPagedClient(t, server, tt.pageSize, tt.maxPages, 0)
+
+			values, err := getList[int](context.Background(), az, newEndpoint("_apis/values"), nil)
+			if err != nil {
+				t.Fatalf("getList returned an error: %v", err)
+			}
+
+			if len(values) != tt.wantCount {
+				t.Errorf("got %d values, want %d", len(values), tt.wantCount)
+			}
+			for i, value := range values {
+				if value != i+1 {
+					t.Fatalf("value %d is %d, want %d", i, value, i+1)
+				}
+			}
+
+			requests := server.requests()
+			if len(requests) != tt.wantPages {
+				t.Fatalf("got %d requests, want %d", len(requests), tt.wantPages)
+			}
+			for i, query := range requests {
+				if query["$top"] != strconv.Itoa(tt.pageSize) {
+					t.Errorf("request %d has $top %q, want %d", i, query["$top"], tt.pageSize)
+				}
+				if query["api-version"] != defaultApiVersion {
+					t.Errorf("request %d has api-version %q, want %q", i, query["api-version"], defaultApiVersion)
+				}
+
+				wantToken := ""
+				if i > 0 {
+					wantToken = strconv.Itoa(i*tt.pageSize + 1)
+				}
+				if query["continuationToken"] != wantToken {
+					t.Errorf("request %d has continuationToken %q, want %q", i, query["continuationToken"], wantToken)
+				}
+			}
+		})
+	}
+}
+
+func TestGetListPageBudget(t *testing.T) {
+	server := &pagedServer{total: 50}
+	az := newPagedClient(t, server, 5, 10, 3)
+	ctx := az.WithPageBudget(context.Background())
+
+	// The first call follows 3 continuation tokens, using up the budget
+	values, err := getList[int](ctx, az, newEndpoint("_apis/values"), nil)
+	if err != nil {
+		t.Fatalf("getList returned an error: %v", err)
+	}
+	if len(values) != 20 {
+		t.Errorf("first call got %d values, want 20", len(values))
+	}
+
+	// Later calls sharing the budget still get their first page, but follow no more
+	values, err = getList[int](ctx, az, newEndpoint("_apis/values"), nil)
+	if err != nil {
+		t.Fatalf("getList returned an error: %v", err)
+	}
+	if len(values) != 5 {
+		t.Errorf("second call got %d values, want 5", len(values))
+	}
+
+	if requests := len(server.requests()); requests != 5 {
+		t.Errorf("got %d requests, want 5", requests)
+	}
+
+	// A new budget, as for the next poll, follows pages again
+	values, err = getList[int](az.WithPageBudget(context.Background()), az, newEndpoint("_apis/values"), nil)
+	if err != nil {
+		t.Fatalf("getList returned an error: %v", err)
+	}
+	if len(values) != 20 {
+		t.Errorf("call with a new budget got %d values, want 20", len(values))
+	}
+}
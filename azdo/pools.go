@@ -0,0 +1,73 @@
+package azdo
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Pool struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	IsHosted bool   `json:"isHosted"`
+	PoolType string `json:"poolType"`
+}
+
+type Agent struct {
+	Id                 int               `json:"id"`
+	Name               string            `json:"name"`
+	Version            string            `json:"version"`
+	OsDescription      string            `json:"osDescription"`
+	Enabled            bool              `json:"enabled"`
+	Status             string            `json:"status"`
+	AssignedRequest    *JobRequest       `json:"assignedRequest"`
+	SystemCapabilities map[string]string `json:"systemCapabilities"`
+}
+
+// JobRequest is a request for an agent of a pool to run a job
+type JobRequest struct {
+	RequestId  int       `json:"requestId"`
+	QueueTime  time.Time `json:"queueTime"`
+	AssignTime time.Time `json:"assignTime"`
+	FinishTime time.Time `json:"finishTime"`
+	Result     string    `json:"result"`
+}
+
+// GetPools returns the agent pools of the organisation or collection
+func (az *AzDoClient) GetPools(ctx context.Context) ([]Pool, error) {
+	log.WithFields(log.Fields{"serverName": az.Name}).Info("Get Pools")
+
+	return getList[Pool](ctx, az, newEndpoint("_apis/distributedtask/pools"), nil)
+}
+
+// GetAgents returns the agents of a pool along with their capabilities and the job they are running, if any
+func (az *AzDoClient) GetAgents(ctx context.Context, poolId int) ([]Agent, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "poolId": poolId}).Info("Get Agents")
+
+	query := url.Values{}
+	query.Set("includeCapabilities", "true")
+	query.Set("includeAssignedRequest", "true")
+
+	return getList[Agent](ctx, az, newEndpoint("_apis/distributedtask/pools/{poolId}/agents", strconv.Itoa(poolId)), query)
+}
+
+// GetQueue returns the agent queue of a project, along with the agent pool behind it
+func (az *AzDoClient) GetQueue(ctx context.Context, projectName string, queueId int) (Queue, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "queueId": queueId}).Debug("Get Queue")
+
+	return getObject[Queue](ctx, az, newEndpoint("{project}/_apis/distributedtask/queues/{queueId}", projectName, strconv.Itoa(queueId)).preview(1), nil)
+}
+
+// GetJobRequests returns the job requests of a pool that are queued or running, along with up to
+// completedRequestCount of the most recently completed ones
+func (az *AzDoClient) GetJobRequests(ctx context.Context, poolId int, completedRequestCount int) ([]JobRequest, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "poolId": poolId}).Info("Get Job Requests")
+
+	query := url.Values{}
+	query.Set("completedRequestCount", strconv.Itoa(completedRequestCount))
+
+	return getList[JobRequest](ctx, az, newEndpoint("_apis/distributedtask/pools/{poolId}/jobrequests", strconv.Itoa(poolId)), query)
+}
@@ -0,0 +1,63 @@
+package azdo
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Deployment is the deployment of a classic release to one of its environments
+type Deployment struct {
+	Id                  int               `json:"id"`
+	Release             ReleaseReference  `json:"release"`
+	ReleaseDefinition   ReleaseReference  `json:"releaseDefinition"`
+	ReleaseEnvironment  ReleaseReference  `json:"releaseEnvironment"`
+	DeploymentStatus    string            `json:"deploymentStatus"`
+	OperationStatus     string            `json:"operationStatus"`
+	QueuedOn            time.Time         `json:"queuedOn"`
+	StartedOn           time.Time         `json:"startedOn"`
+	CompletedOn         time.Time         `json:"completedOn"`
+	PreDeployApprovals  []ReleaseApproval `json:"preDeployApprovals"`
+	PostDeployApprovals []ReleaseApproval `json:"postDeployApprovals"`
+}
+
+// ReleaseReference identifies a release, release definition or release environment
+type ReleaseReference struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ReleaseApproval is an approval needed before or after a release is deployed to an environment
+type ReleaseApproval struct {
+	Id                 int              `json:"id"`
+	Status             string           `json:"status"`
+	ApprovalType       string           `json:"approvalType"`
+	IsAutomated        bool             `json:"isAutomated"`
+	CreatedOn          time.Time        `json:"createdOn"`
+	ModifiedOn         time.Time        `json:"modifiedOn"`
+	Release            ReleaseReference `json:"release"`
+	ReleaseDefinition  ReleaseReference `json:"releaseDefinition"`
+	ReleaseEnvironment ReleaseReference `json:"releaseEnvironment"`
+}
+
+// GetDeployments returns up to count of the most recent deployments of the classic releases of a project
+func (az *AzDoClient) GetDeployments(ctx context.Context, projectName string, count int) ([]Deployment, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName}).Info("Get Deployments")
+
+	query := url.Values{}
+	query.Set("queryOrder", "descending")
+
+	return getFirstPage[Deployment](ctx, az, newReleaseEndpoint("{project}/_apis/release/deployments", projectName), query, count)
+}
+
+// GetPendingApprovals returns the approvals of the classic releases of a project that are waiting for someone to approve them
+func (az *AzDoClient) GetPendingApprovals(ctx context.Context, projectName string) ([]ReleaseApproval, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName}).Info("Get Pending Approvals")
+
+	query := url.Values{}
+	query.Set("statusFilter", "pending")
+
+	return getList[ReleaseApproval](ctx, az, newReleaseEndpoint("{project}/_apis/release/approvals", projectName), query)
+}
@@ -0,0 +1,62 @@
+package azdo
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestRun is a run of the tests of a build, such as the tests published by one test task
+type TestRun struct {
+	Id                 int              `json:"id"`
+	Name               string           `json:"name"`
+	State              string           `json:"state"`
+	TotalTests         int              `json:"totalTests"`
+	PassedTests        int              `json:"passedTests"`
+	UnanalyzedTests    int              `json:"unanalyzedTests"`
+	NotApplicableTests int              `json:"notApplicableTests"`
+	StartedDate        time.Time        `json:"startedDate"`
+	CompletedDate      time.Time        `json:"completedDate"`
+	RunStatistics      []TestRunOutcome `json:"runStatistics"`
+}
+
+// TestRunOutcome is the number of tests of a run with an outcome
+type TestRunOutcome struct {
+	State          string `json:"state"`
+	Outcome        string `json:"outcome"`
+	ResultMetadata string `json:"resultMetadata"` // Set to flaky for the tests AzDO has marked as flaky
+	Count          int    `json:"count"`
+}
+
+// TestResult is the outcome of a single test of a test run
+type TestResult struct {
+	Id                int    `json:"id"`
+	TestCaseTitle     string `json:"testCaseTitle"`
+	AutomatedTestName string `json:"automatedTestName"`
+	Outcome           string `json:"outcome"`
+}
+
+// GetTestRuns returns the test runs of a build along with the number of tests of each outcome
+func (az *AzDoClient) GetTestRuns(ctx context.Context, projectName string, buildId int) ([]TestRun, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "buildId": buildId}).Debug("Get Test Runs")
+
+	query := url.Values{}
+	query.Set("buildUri", "vstfs:///Build/Build/"+strconv.Itoa(buildId))
+	query.Set("includeRunDetails", "true")
+
+	return getList[TestRun](ctx, az, newEndpoint("{project}/_apis/test/runs", projectName), query)
+}
+
+// GetTestResults returns the results of a test run with one of the outcomes, such as Failed
+func (az *AzDoClient) GetTestResults(ctx context.Context, projectName string, runId int, outcomes ...string) ([]TestResult, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "runId": runId, "outcomes": outcomes}).Debug("Get Test Results")
+
+	query := url.Values{}
+	query.Set("outcomes", strings.Join(outcomes, ","))
+
+	return getList[TestResult](ctx, az, newEndpoint("{project}/_apis/test/runs/{runId}/results", projectName, strconv.Itoa(runId)), query)
+}
@@ -0,0 +1,151 @@
+package azdo
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	retryAfterHeader         = "Retry-After"
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	rateLimitDelayHeader     = "X-RateLimit-Delay"
+
+	// Once the remaining budget falls below this fraction of the limit, requests are slowed down
+	slowdownThreshold = 0.25
+	// Pause added before each request when the remaining budget is exhausted
+	maxSlowdown = 5 * time.Second
+)
+
+// ThrottleState is the rate limiting Azure DevOps last reported to the client
+type ThrottleState struct {
+	Limit      float64       // TSTUs allowed within the sliding window, from X-RateLimit-Limit
+	Remaining  float64       // TSTUs remaining before requests are blocked, from X-RateLimit-Remaining
+	Delay      time.Duration // Delay AzDO applied to the last request, from X-RateLimit-Delay
+	BlockedFor time.Duration // Time left before requests are sent again, from Retry-After and X-RateLimit-Delay
+}
+
+// Throttle paces the requests made by a client, honouring the rate limiting headers returned
+// by Azure DevOps and an optional requests per second limit.
+type Throttle struct {
+	limiter *rate.Limiter
+
+	lock      sync.Mutex
+	state     ThrottleState
+	notBefore time.Time
+}
+
+// NewThrottle creates a Throttle allowing requestsPerSecond, or unlimited requests if it is not positive
+func NewThrottle(requestsPerSecond float64) *Throttle {
+	limit := rate.Inf
+	if requestsPerSecond > 0 {
+		limit = rate.Limit(requestsPerSecond)
+	}
+	return &Throttle{limiter: rate.NewLimiter(limit, 1)}
+}
+
+// State returns the current throttling state
+func (t *Throttle) State() ThrottleState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state := t.state
+	if blockedFor := time.Until(t.notBefore); blockedFor > 0 {
+		state.BlockedFor = blockedFor
+	}
+	return state
+}
+
+// wait blocks until the next request is allowed to be sent, or the context is done
+func (t *Throttle) wait(ctx context.Context) error {
+	timer := time.NewTimer(t.pause())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	return t.limiter.Wait(ctx)
+}
+
+// pause returns how long to hold off before sending the next request
+func (t *Throttle) pause() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	pause := time.Until(t.notBefore)
+
+	// Slow down gradually as the remaining budget drops rather than waiting to be blocked
+	if t.state.Limit > 0 {
+		fraction := t.state.Remaining / t.state.Limit
+		if fraction < slowdownThreshold {
+			slowdown := time.Duration(float64(maxSlowdown) * (1 - fraction/slowdownThreshold))
+			if slowdown > pause {
+				pause = slowdown
+			}
+		}
+	}
+
+	if pause < 0 {
+		return 0
+	}
+	return pause
+}
+
+// observe updates the throttling state from the headers of a response
+func (t *Throttle) observe(header http.Header) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if limit, err := strconv.ParseFloat(header.Get(rateLimitLimitHeader), 64); err == nil {
+		t.state.Limit = limit
+	}
+
+	if remaining, err := strconv.ParseFloat(header.Get(rateLimitRemainingHeader), 64); err == nil {
+		t.state.Remaining = remaining
+	} else if t.state.Limit > 0 && header.Get(rateLimitLimitHeader) == "" {
+		// Headers are only sent while close to the limit, so their absence means the budget has recovered
+		t.state.Remaining = t.state.Limit
+	}
+
+	t.state.Delay = 0
+	if delay, err := strconv.ParseFloat(header.Get(rateLimitDelayHeader), 64); err == nil {
+		t.state.Delay = time.Duration(delay * float64(time.Second))
+		t.holdOff(t.state.Delay)
+	}
+
+	if retryAfter, ok := parseRetryAfter(header.Get(retryAfterHeader)); ok {
+		t.holdOff(retryAfter)
+	}
+}
+
+// holdOff stops any request being sent for d, unless a longer hold off is already in place
+func (t *Throttle) holdOff(d time.Duration) {
+	if notBefore := time.Now().Add(d); notBefore.After(t.notBefore) {
+		t.notBefore = notBefore
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or a http date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package azdo
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// within reports if got is want, allowing for the time passed since want was worked out
+func within(got time.Duration, want time.Duration) bool {
+	return got <= want && got > want-time.Second
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{name: "missing"},
+		{name: "seconds", value: "30", want: 30 * time.Second, wantOk: true},
+		{name: "http date", value: time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), want: time.Minute, wantOk: true},
+		{name: "invalid", value: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if ok != tt.wantOk {
+				t.Fatalf("parseRetryAfter(%q) ok is %v, want %v", tt.value, ok, tt.wantOk)
+			}
+			// A http date only has second precision
+			if ok && !within(got, tt.want) && !within(got+time.Second, tt.want) {
+				t.Errorf("parseRetryAfter(%q) is %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleObserve(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       []map[string]string // Headers of the responses observed, in order
+		wantPause     time.Duration
+		wantRemaining float64
+	}{
+		{name: "no headers", headers: []map[string]string{{}}},
+		{
+			name:      "retry after seconds",
+			headers:   []map[string]string{{retryAfterHeader: "10"}},
+			wantPause: 10 * time.Second,
+		},
+		{
+			name:      "retry after http date",
+			headers:   []map[string]string{{retryAfterHeader: time.Now().Add(20 * time.Second).UTC().Format(http.TimeFormat)}},
+			wantPause: 20 * time.Second,
+		},
+		{
+			name:      "delay",
+			headers:   []map[string]string{{rateLimitDelayHeader: "1.5"}},
+			wantPause: 1500 * time.Millisecond,
+		},
+		{
+			name:      "longest hold off wins",
+			headers:   []map[string]string{{retryAfterHeader: "10", rateLimitDelayHeader: "2"}},
+			wantPause: 10 * time.Second,
+		},
+		{
+			name:          "plenty of budget remaining",
+			headers:       []map[string]string{{rateLimitLimitHeader: "200", rateLimitRemainingHeader: "100"}},
+			wantRemaining: 100,
+		},
+		{
+			name:          "slows down as the budget drops",
+			headers:       []map[string]string{{rateLimitLimitHeader: "200", rateLimitRemainingHeader: "25"}},
+			wantPause:     maxSlowdown / 2,
+			wantRemaining: 25,
+		},
+		{
+			name:          "budget exhausted",
+			headers:       []map[string]string{{rateLimitLimitHeader: "200", rateLimitRemainingHeader: "0"}},
+			wantPause:     maxSlowdown,
+			wantRemaining: 0,
+		},
+		{
+			name: "budget recovers once the headers stop",
+			headers: []map[string]string{
+				{rateLimitLimitHeader: "200", rateLimitRemainingHeader: "0"},
+				{},
+			},
+			wantRemaining: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttle := NewThrottle(0)
+			for _, headers := range tt.headers {
+				header := http.Header{}
+				for key, value := range headers {
+					header.Set(key, value)
+				}
+				throttle.observe(header)
+			}
+
+			pause := throttle.pause()
+			// A http date only has second precision
+			if !within(pause, tt.wantPause) && !within(pause+time.Second, tt.wantPause) {
+				t.Errorf("pause is %v, want %v", pause, tt.wantPause)
+			}
+			if remaining := throttle.State().Remaining; remaining != tt.wantRemaining {
+				t.Errorf("remaining is %v, want %v", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
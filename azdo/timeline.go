@@ -0,0 +1,45 @@
+package azdo
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeline holds the records of the stages, jobs and tasks of a build
+type Timeline struct {
+	Id      string           `json:"id"`
+	Records []TimelineRecord `json:"records"`
+}
+
+// TimelineRecord is a stage, job, task or other step of a build
+type TimelineRecord struct {
+	Id         string         `json:"id"`
+	ParentId   string         `json:"parentId"`
+	Type       string         `json:"type"`
+	Name       string         `json:"name"`
+	State      string         `json:"state"`
+	Result     string         `json:"result"`
+	StartTime  time.Time      `json:"startTime"`
+	FinishTime time.Time      `json:"finishTime"`
+	WorkerName string         `json:"workerName"`
+	QueueId    int            `json:"queueId"`
+	Attempt    int            `json:"attempt"`
+	Task       *TaskReference `json:"task"`
+}
+
+// TaskReference identifies the task, and the version of it, a task record ran
+type TaskReference struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// GetTimeline returns the timeline of a build
+func (az *AzDoClient) GetTimeline(ctx context.Context, projectName string, buildId int) (Timeline, error) {
+	log.WithFields(log.Fields{"serverName": az.Name, "project": projectName, "buildId": buildId}).Debug("Get Timeline")
+
+	return getObject[Timeline](ctx, az, newEndpoint("{project}/_apis/build/builds/{buildId}/timeline", projectName, strconv.Itoa(buildId)), nil)
+}
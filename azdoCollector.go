@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,79 +13,408 @@ import (
 )
 
 type azDoCollector struct {
-	AzDoClient *azdo.AzDoClient
-	lastScrape time.Time
+	AzDoClient    *azdo.AzDoClient
+	scrapeTimeout time.Duration
+	pollInterval  time.Duration
+
+	// watermarkOverlap is how far before the watermark finished builds are requested again
+	watermarkOverlap time.Duration
+	ledger           *seenLedger
+
+	// watermarks holds, per project, the finish time of the newest build already reported
+	watermarks     map[string]time.Time
+	watermarksLock sync.Mutex
+
+	// pool runs the requests for each project, limiting how many are made at once
+	pool *workerPool
+
+	// scrapers retrieve metrics that don't depend on the builds, alongside the builds
+	scrapers    []scraper
+	agentPools  bool
+	jobRequests bool
+
+	// followUps retrieve more detail about each newly finished build, by name. The builds still to be
+	// followed up are queued until their follow-up succeeds.
+	followUps        map[string]buildFollowUp
+	followUpQueue    *followUpQueue
+	followUpsDropped *prometheus.CounterVec
+
+	// store saves the state of the collector every saveInterval, if it is set
+	store        *stateStore
+	saveInterval time.Duration
+
+	// snapshot holds the metrics calculated by the last successful poll, served on every scrape
+	snapshot atomic.Pointer[metricsSnapshot]
+
+	scrapeErrors     *prometheus.CounterVec
+	poolScrapeErrors *prometheus.CounterVec
+
+	// buildLabels are the optional labels of the build results and durations
+	buildLabels buildLabels
+
+	// Counters accumulated across polls
+	buildResults     *counterSet
+	buildDurations   *buildDurationHistograms
+	jobRequestLedger *seenLedger
+	jobWaitTimes     *histogramSet
+	timeline         *timelineMetrics
+	agentJobs        *agentJobMetrics
+	environments     *environmentMetrics
+	releases         *releaseMetrics
+	dora             *doraMetrics
+	tests            *testMetrics
+	flakyTests       *flakyTestMetrics // Only set when flaky tests are collected
+	coverage         *coverageMetrics
+}
+
+// scraper retrieves a set of metrics from AzDO for a poll
+type scraper func(ctx context.Context, projects []azdo.Project) []prometheus.Metric
+
+// buildFollowUp retrieves more detail about a newly finished build, accumulating it into the collector.
+// It returns an error, having accumulated nothing, if the detail couldn't be retrieved.
+type buildFollowUp func(ctx context.Context, project azdo.Project, build azdo.Build) error
+
+// The metrics calculated by a poll of the server, when that poll finished and why it failed, if it did
+type metricsSnapshot struct {
+	Metrics []prometheus.Metric
+	Taken   time.Time
+	Err     error
 }
 
-func newAzDoCollector(az azdo.AzDoClient) *azDoCollector {
-	return &azDoCollector{AzDoClient: &az}
+func newAzDoCollector(server azDoConfig, global globalSlots, store *stateStore, saveInterval time.Duration) *azDoCollector {
+	buildLabels := newBuildLabels(server)
+
+	azc := &azDoCollector{
+		AzDoClient:       &server.AzDoClient,
+		scrapeTimeout:    server.ScrapeTimeout,
+		pollInterval:     server.PollInterval,
+		watermarkOverlap: server.WatermarkOverlap,
+		ledger:           newSeenLedger(server.LedgerTTL),
+		pool:             newWorkerPool(server.Concurrency, global),
+		store:            store,
+		saveInterval:     saveInterval,
+		watermarks:       make(map[string]time.Time),
+		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azdo_scrape_errors_total",
+			Help: "Total of failed requests to AzDO, by project and kind of error",
+		}, []string{"project", "kind"}),
+		poolScrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azdo_pool_scrape_errors_total",
+			Help: "Total of failed requests to AzDO for agent pools, by pool and kind of error",
+		}, []string{"pool", "kind"}),
+		followUps:     make(map[string]buildFollowUp),
+		followUpQueue: newFollowUpQueue(server.LedgerTTL),
+		followUpsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "azdo_build_follow_ups_dropped_total",
+			Help: "Total of finished builds whose detail couldn't be retrieved by the follow-up within the ledger ttl",
+		}, []string{"project", "follow_up"}),
+		buildLabels:      buildLabels,
+		buildResults:     newCounterSet(newBuildResultsTotalDesc(buildLabels)),
+		buildDurations:   newBuildDurationHistograms(server.HistogramsByDefinition, buildLabels),
+		agentPools:       server.AgentPools,
+		jobRequests:      server.JobRequests,
+		jobRequestLedger: newSeenLedger(server.LedgerTTL),
+		jobWaitTimes:     newHistogramSet(poolJobWaitDesc, prometheus.ExponentialBuckets(1, 2, 14)), // 1 second up to ~2.3 hours
+		timeline:         newTimelineMetrics(server.TimelineDefinitions, server.TaskFailures),
+		agentJobs:        newAgentJobMetrics(server.AgentJobs, server.AgentFailureWindow),
+		environments:     newEnvironmentMetrics(server.Environments, server.LedgerTTL),
+		releases:         newReleaseMetrics(server.LedgerTTL),
+		dora:             newDoraMetrics(server.Dora, server.LedgerTTL),
+		tests:            newTestMetrics(),
+		coverage:         newCoverageMetrics(server.CoverageBranches),
+	}
+
+	if server.AgentPools || server.JobRequests {
+		azc.scrapers = append(azc.scrapers, azc.scrapeAgentPools)
+	}
+	// The DORA metrics are calculated from the deployments to the environments, even if they aren't published
+	if server.Environments || server.Dora.enabled() {
+		azc.scrapers = append(azc.scrapers, azc.scrapeEnvironments)
+	}
+	if server.Releases {
+		azc.scrapers = append(azc.scrapers, azc.scrapeReleases)
+	}
+	if len(server.TimelineDefinitions) > 0 || server.TaskFailures || server.AgentJobs {
+		azc.followUps["timeline"] = azc.followUpTimeline
+	}
+	if server.FlakyTests {
+		azc.flakyTests = newFlakyTestMetrics(server.FlakyTestWindow, server.FlakyTestTopN)
+	}
+	if server.TestRuns || server.FlakyTests {
+		azc.followUps["tests"] = azc.followUpTests
+	}
+	if len(server.CoverageBranches) > 0 {
+		azc.followUps["coverage"] = azc.followUpCoverage
+	}
+
+	return azc
 }
 
 func (azc *azDoCollector) Describe(ch chan<- *prometheus.Desc) {
 	prometheus.DescribeByCollect(azc, ch)
 }
 
+// Collect publishes the last snapshot taken by the poller, it never calls AzDO itself
 func (azc *azDoCollector) Collect(publishMetrics chan<- prometheus.Metric) {
-	
+
+	azc.scrapeErrors.Collect(publishMetrics)
+	azc.poolScrapeErrors.Collect(publishMetrics)
+	azc.followUpsDropped.Collect(publishMetrics)
+	azc.followUpQueue.Collect(publishMetrics)
+	azc.collectThrottleMetrics(publishMetrics)
+	azc.pool.Collect(publishMetrics)
+	azc.buildResults.Collect(publishMetrics)
+	azc.buildDurations.Collect(publishMetrics)
+	azc.jobWaitTimes.Collect(publishMetrics)
+	azc.timeline.Collect(publishMetrics)
+	azc.agentJobs.Collect(publishMetrics)
+	azc.environments.Collect(publishMetrics)
+	azc.releases.Collect(publishMetrics)
+	azc.dora.Collect(publishMetrics)
+	azc.tests.Collect(publishMetrics)
+	if azc.flakyTests != nil {
+		azc.flakyTests.Collect(publishMetrics)
+	}
+	azc.coverage.Collect(publishMetrics)
+
+	for project, size := range azc.ledger.size() {
+		publishMetrics <- prometheus.MustNewConstMetric(ledgerSizeDesc, prometheus.GaugeValue, float64(size), project)
+	}
+
+	snapshot := azc.snapshot.Load()
+	if snapshot == nil {
+		return
+	}
+
+	for _, metric := range snapshot.Metrics {
+		publishMetrics <- metric
+	}
+
+	// Surface the failure of the last poll to Prometheus, the other metrics are still served
+	if snapshot.Err != nil {
+		publishMetrics <- prometheus.NewInvalidMetric(upDesc, snapshot.Err)
+	}
+
+	publishMetrics <- prometheus.MustNewConstMetric(
+		snapshotAgeDesc,
+		prometheus.GaugeValue,
+		time.Since(snapshot.Taken).Seconds(),
+	)
+}
+
+// run polls the server every pollInterval until the context is cancelled. State is saved
+// between polls so it is never saved half way through accounting for a poll.
+func (azc *azDoCollector) run(ctx context.Context) {
+	azc.pool.start(ctx)
+
+	ticker := time.NewTicker(azc.pollInterval)
+	defer ticker.Stop()
+
+	lastSaved := time.Now()
+	for {
+		azc.poll(ctx)
+
+		if time.Since(lastSaved) >= azc.saveInterval {
+			azc.saveState()
+			lastSaved = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			azc.saveState()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll retrieves the builds of the server and swaps in a new snapshot of the metrics calculated from them
+func (azc *azDoCollector) poll(ctx context.Context) {
+
 	start := time.Now()
-	
-	projects,err := azc.AzDoClient.GetProjects()
+
+	// Abandon a slow server once the deadline passes, publishing whatever was retrieved in time
+	ctx, cancel := context.WithTimeout(ctx, azc.scrapeTimeout)
+	defer cancel()
+	ctx = azc.AzDoClient.WithPageBudget(ctx)
+
+	azc.ledger.evict(start)
+	azc.jobRequestLedger.evict(start)
+	azc.environments.ledger.evict(start)
+	azc.releases.ledger.evict(start)
+	azc.dora.shipped.evict(start)
+	azc.evictFollowUps(start)
+
+	projects, err := azc.AzDoClient.GetProjects(ctx)
 
 	if err != nil {
+		// Without the projects there is nothing to publish other than the server being down
+		azc.recordError("", err)
+		azc.snapshot.Store(&metricsSnapshot{
+			Metrics: []prometheus.Metric{
+				prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 0),
+				prometheus.MustNewConstMetric(totalcollectDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds()),
+			},
+			Taken: time.Now(),
+			Err:   err,
+		})
 		return
 	}
 
 	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name}).Info("Retrieved Projects")
 
+	chanScraped := azc.runScrapers(ctx, projects)
+	chanBuilds := azc.scrapeBuilds(ctx, projects)
 
-	chanBuilds, errOccurred := azc.scrapeBuilds(projects)
-	if errOccurred {
-		return
-	}
-	
 	chanCalculatedMetrics := azc.calculateMetrics(chanBuilds)
 
-	//Publish the buffered metrics
+	metrics := []prometheus.Metric{}
 	for metric := range chanCalculatedMetrics {
-		publishMetrics <- metric
+		metrics = append(metrics, metric)
 	}
+	metrics = append(metrics, <-chanScraped...)
 
-	publishMetrics <- prometheus.MustNewConstMetric(
-		totalcollectDurationDesc,
-		prometheus.GaugeValue,
-		time.Since(start).Seconds(),
+	metrics = append(metrics,
+		prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, 1),
+		prometheus.MustNewConstMetric(totalcollectDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds()),
 	)
 
-	azc.lastScrape = time.Now()
+	azc.snapshot.Store(&metricsSnapshot{Metrics: metrics, Taken: time.Now()})
+	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "metrics": len(metrics)}).Info("Snapshot updated")
 }
 
-func (azc *azDoCollector) scrapeBuilds(projects []azdo.Project) (<-chan metricsContext,bool) {
+// runScrapers runs every scraper at once, sending all the metrics they retrieved once they have finished
+func (azc *azDoCollector) runScrapers(ctx context.Context, projects []azdo.Project) <-chan []prometheus.Metric {
+	scraped := make(chan []prometheus.Metric, 1)
+
+	go func() {
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		metrics := []prometheus.Metric{}
+
+		for _, scrape := range azc.scrapers {
+			wg.Add(1)
+			go func(scrape scraper) {
+				defer wg.Done()
+				scrapedMetrics := scrape(ctx, projects)
+
+				lock.Lock()
+				metrics = append(metrics, scrapedMetrics...)
+				lock.Unlock()
+			}(scrape)
+		}
+
+		wg.Wait()
+		scraped <- metrics
+	}()
+	return scraped
+}
+
+func (azc *azDoCollector) scrapeBuilds(ctx context.Context, projects []azdo.Project) <-chan metricsContext {
 
 	metrics := make(chan metricsContext)
-	errOccurred := false
 
 	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name}).Info("calculateMetrics")
 	var wg sync.WaitGroup
 
 	for _, project := range projects {
 		wg.Add(1)
-		go func(p azdo.Project) {
+		p := project
+		azc.pool.submit(p.Name, func() {
 			log.Info(p.Name)
-			finishedBuilds,currentBuilds, err := azc.AzDoClient.GetBuilds(p.Name,azc.lastScrape)
+			pollStart := time.Now()
+			watermark := azc.watermark(p.Name)
+
+			// Query back past the watermark so builds reported late or with skewed clocks are not missed,
+			// the ledger drops the ones already accounted for.
+			after := watermark
+			if !after.IsZero() {
+				after = after.Add(-azc.watermarkOverlap)
+			}
+
+			finishedBuilds, currentBuilds, err := azc.AzDoClient.GetBuilds(ctx, p.Name, after)
 			if err != nil {
-				errOccurred = true
+				// Don't publish the builds of a failed project, the other projects are still published
+				azc.recordError(p.Name, err)
+				metrics <- metricsContext{Project: p, Err: err}
+				wg.Done()
+				return
+			}
+			azc.advanceWatermark(p.Name, watermark, pollStart, finishedBuilds)
+			finishedBuilds = azc.ledger.admit(p.Name, finishedBuilds, pollStart)
+
+			// The builds that couldn't be followed up by earlier polls are followed up again along with
+			// the new ones. Queued behind the other projects, rather than run here, so each project gets its turn.
+			azc.followUpQueue.add(azc.followUpNames(), p, finishedBuilds, pollStart)
+			for _, pending := range azc.followUpQueue.due(p.Name) {
+				wg.Add(1)
+				f := pending
+				azc.pool.submit(p.Name, func() {
+					defer wg.Done()
+					azc.runFollowUp(ctx, f)
+				})
 			}
 
-			metrics <- metricsContext{Project:p, Builds: finishedBuilds, Current: currentBuilds}
+			metrics <- metricsContext{Project: p, Builds: finishedBuilds, Current: currentBuilds}
 			wg.Done()
-		}(project)
+		})
 	}
 
 	go func() {
 		wg.Wait()
 		close(metrics)
 	}()
-	return metrics, errOccurred
+	return metrics
+}
+
+func (azc *azDoCollector) collectThrottleMetrics(publishMetrics chan<- prometheus.Metric) {
+	if azc.AzDoClient.Throttle == nil {
+		return
+	}
+
+	for _, metric := range calculateThrottleMetrics(azc.AzDoClient.Throttle.State()) {
+		publishMetrics <- metric
+	}
+}
+
+// recordError logs a failed request and counts it against the project it was for and its kind of error
+func (azc *azDoCollector) recordError(project string, err error) {
+	kind := azdo.ErrorKindOf(err)
+	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "project": project, "kind": kind, "error": err}).Error("Request to AzDO failed")
+	azc.scrapeErrors.WithLabelValues(project, string(kind)).Inc()
+}
+
+// recordPoolError is recordError for the requests for agent pools, counted against the pool they were
+// for, or no pool if listing the pools failed
+func (azc *azDoCollector) recordPoolError(pool string, err error) {
+	kind := azdo.ErrorKindOf(err)
+	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "pool": pool, "kind": kind, "error": err}).Error("Request to AzDO failed")
+	azc.poolScrapeErrors.WithLabelValues(pool, string(kind)).Inc()
+}
+
+func (azc *azDoCollector) watermark(project string) time.Time {
+	azc.watermarksLock.Lock()
+	defer azc.watermarksLock.Unlock()
+	return azc.watermarks[project]
+}
+
+// advanceWatermark moves the watermark of a project on to the newest finish time returned. On the first
+// poll of a project there is no watermark, so it starts from when that poll began.
+func (azc *azDoCollector) advanceWatermark(project string, watermark time.Time, pollStart time.Time, finishedBuilds []azdo.Build) {
+	next := watermark
+	if next.IsZero() {
+		next = pollStart
+	}
+
+	for _, build := range finishedBuilds {
+		if build.FinishTime.After(next) {
+			next = build.FinishTime
+		}
+	}
+
+	azc.watermarksLock.Lock()
+	defer azc.watermarksLock.Unlock()
+	azc.watermarks[project] = next
 }
 
 func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsContext) <-chan prometheus.Metric {
@@ -91,7 +422,16 @@ func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsCo
 
 	go func() {
 		for mc := range metricsContextChanIn {
-			
+
+			if mc.Err != nil {
+				metrics <- prometheus.MustNewConstMetric(projectScrapeSuccessDesc, prometheus.GaugeValue, 0, mc.Project.Name)
+				continue
+			}
+			metrics <- prometheus.MustNewConstMetric(projectScrapeSuccessDesc, prometheus.GaugeValue, 1, mc.Project.Name)
+
+			accumulateBuildResults(mc, azc.buildResults, azc.buildLabels)
+			azc.buildDurations.Observe(mc)
+
 			buildMetrics := calculateBuildMetrics(mc)
 
 			for _, buildMetric := range buildMetrics {
@@ -106,6 +446,7 @@ func (azc *azDoCollector) calculateMetrics(metricsContextChanIn <-chan metricsCo
 // Contains all the information needed to calculate the metrics
 type metricsContext struct {
 	Project azdo.Project
-	Builds   []azdo.Build
+	Builds  []azdo.Build
 	Current []azdo.Build
+	Err     error // Set if the builds of the project couldn't be retrieved
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+// pollFinishedBuilds does what a poll of a project does with its finished builds: it requests the
+// builds finished after the watermark less the overlap, as AzDO would return them, advances the
+// watermark and returns the builds the ledger admits.
+func pollFinishedBuilds(azc *azDoCollector, project string, finished []azdo.Build, pollStart time.Time) []azdo.Build {
+	watermark := azc.watermark(project)
+
+	returned := []azdo.Build{}
+	if !watermark.IsZero() {
+		after := watermark.Add(-azc.watermarkOverlap)
+		for _, build := range finished {
+			if build.FinishTime.After(after) && !build.FinishTime.After(pollStart) {
+				returned = append(returned, build)
+			}
+		}
+	}
+
+	azc.advanceWatermark(project, watermark, pollStart, returned)
+	return azc.ledger.admit(project, returned, pollStart)
+}
+
+func TestWatermarkAndLedgerAcrossPolls(t *testing.T) {
+	azc := &azDoCollector{
+		watermarkOverlap: 10 * time.Minute,
+		ledger:           newSeenLedger(2 * time.Hour),
+		watermarks:       make(map[string]time.Time),
+	}
+
+	// Builds as they finished on the server, a late build is only reported after the second poll
+	first := finishedBuild(1, time.Minute, "succeeded")
+	second := finishedBuild(2, 2*time.Minute, "failed")
+	late := finishedBuild(3, 90*time.Second, "canceled")
+	rerun := finishedBuild(2, 8*time.Minute, "succeeded")
+
+	// The first poll only sets the watermark
+	if got := pollFinishedBuilds(azc, "project", []azdo.Build{}, ledgerStart); len(got) != 0 {
+		t.Fatalf("first poll admitted %v, want none", buildIds(got))
+	}
+	if got := azc.watermark("project"); !got.Equal(ledgerStart) {
+		t.Fatalf("watermark after the first poll is %v, want %v", got, ledgerStart)
+	}
+
+	// The second poll counts the builds finished since
+	got := pollFinishedBuilds(azc, "project", []azdo.Build{first, second}, ledgerStart.Add(5*time.Minute))
+	if ids := buildIds(got); !equalIds(ids, []int{1, 2}) {
+		t.Errorf("second poll admitted %v, want [1 2]", ids)
+	}
+	if got := azc.watermark("project"); !got.Equal(second.FinishTime) {
+		t.Errorf("watermark after the second poll is %v, want %v", got, second.FinishTime)
+	}
+
+	// The third poll overlaps the second, so the builds already counted are returned again with the
+	// late build and the re-run, only the late build and the re-run are counted
+	got = pollFinishedBuilds(azc, "project", []azdo.Build{first, late, rerun}, ledgerStart.Add(10*time.Minute))
+	if ids := buildIds(got); !equalIds(ids, []int{3, 2}) {
+		t.Errorf("third poll admitted %v, want [3 2]", ids)
+	}
+	if got := azc.watermark("project"); !got.Equal(rerun.FinishTime) {
+		t.Errorf("watermark after the third poll is %v, want %v", got, rerun.FinishTime)
+	}
+
+	// Nothing new has finished, so nothing is counted again
+	got = pollFinishedBuilds(azc, "project", []azdo.Build{first, late, rerun}, ledgerStart.Add(15*time.Minute))
+	if len(got) != 0 {
+		t.Errorf("fourth poll admitted %v, want none", buildIds(got))
+	}
+}
+
+func TestAdvanceWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark time.Time
+		builds    []azdo.Build
+		want      time.Time
+	}{
+		{name: "first poll starts from the poll", want: ledgerStart.Add(time.Hour)},
+		{name: "no builds keeps the watermark", watermark: ledgerStart, want: ledgerStart},
+		{
+			name:      "moves on to the newest build",
+			watermark: ledgerStart,
+			builds:    []azdo.Build{finishedBuild(1, 3*time.Minute, "succeeded"), finishedBuild(2, 7*time.Minute, "failed")},
+			want:      ledgerStart.Add(7 * time.Minute),
+		},
+		{
+			name:      "never moves back for builds in the overlap",
+			watermark: ledgerStart,
+			builds:    []azdo.Build{finishedBuild(1, -5*time.Minute, "succeeded")},
+			want:      ledgerStart,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azc := &azDoCollector{watermarks: make(map[string]time.Time)}
+			azc.advanceWatermark("project", tt.watermark, ledgerStart.Add(time.Hour), tt.builds)
+
+			if got := azc.watermark("project"); !got.Equal(tt.want) {
+				t.Errorf("watermark is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// buildsServer serves the finished builds of a project as AzDO does, from minTime in the order asked
+// for and a page at a time. It returns no queued or running builds.
+func buildsServer(t *testing.T, finished []azdo.Build) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		builds := []azdo.Build{}
+
+		if query.Get("statusFilter") == "completed" {
+			if order := query.Get("queryOrder"); order != "finishTimeAscending" {
+				t.Errorf("finished builds requested in %q order, want finishTimeAscending", order)
+			}
+			minTime, err := time.Parse(time.RFC3339Nano, query.Get("minTime"))
+			if err != nil {
+				t.Errorf("invalid minTime %q: %v", query.Get("minTime"), err)
+			}
+
+			for _, build := range finished {
+				if !build.FinishTime.Before(minTime) {
+					builds = append(builds, build)
+				}
+			}
+			sort.Slice(builds, func(i, j int) bool { return builds[i].FinishTime.Before(builds[j].FinishTime) })
+
+			top, _ := strconv.Atoi(query.Get("$top"))
+			start, _ := strconv.Atoi(query.Get("continuationToken"))
+			builds = builds[start:]
+			if len(builds) > top {
+				builds = builds[:top]
+				w.Header().Set("x-ms-continuationtoken", strconv.Itoa(start+top))
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{"count": len(builds), "value": builds})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestScrapeBuildsTruncated(t *testing.T) {
+	finished := []azdo.Build{}
+	for id := 1; id <= 6; id++ {
+		finished = append(finished, finishedBuild(id, time.Duration(id)*time.Minute, "succeeded"))
+	}
+	server := buildsServer(t, finished)
+
+	// Only two pages of two builds are followed, so a poll can't return all six
+	azc := newAzDoCollector(azDoConfig{
+		AzDoClient:       azdo.AzDoClient{Client: server.Client(), Name: "test", Address: server.URL, PageSize: 2, MaxPages: 2},
+		ScrapeTimeout:    time.Minute,
+		Concurrency:      1,
+		WatermarkOverlap: 30 * time.Second,
+		LedgerTTL:        2 * time.Hour,
+	}, nil, nil, time.Minute)
+	azc.pool.start(t.Context())
+	azc.watermarks["project"] = ledgerStart
+
+	poll := func() []int {
+		ids := []int{}
+		for mc := range azc.scrapeBuilds(t.Context(), []azdo.Project{{Name: "project"}}) {
+			if mc.Err != nil {
+				t.Fatalf("scrapeBuilds returned an error: %v", mc.Err)
+			}
+			ids = append(ids, buildIds(mc.Builds)...)
+		}
+		return ids
+	}
+
+	// The oldest builds are returned, the watermark only moves on to the newest of them
+	if ids := poll(); !equalIds(ids, []int{1, 2, 3, 4}) {
+		t.Errorf("first poll admitted %v, want [1 2 3 4]", ids)
+	}
+	if got, want := azc.watermark("project"), ledgerStart.Add(4*time.Minute); !got.Equal(want) {
+		t.Errorf("watermark after the first poll is %v, want %v", got, want)
+	}
+
+	// The builds that were cut off are returned by the next poll
+	if ids := poll(); !equalIds(ids, []int{5, 6}) {
+		t.Errorf("second poll admitted %v, want [5 6]", ids)
+	}
+	if got, want := azc.watermark("project"), ledgerStart.Add(6*time.Minute); !got.Equal(want) {
+		t.Errorf("watermark after the second poll is %v, want %v", got, want)
+	}
+}
+
+func TestScrapeBuildsFollowsUpAgain(t *testing.T) {
+	server := buildsServer(t, []azdo.Build{finishedBuild(1, time.Minute, "failed")})
+
+	azc := newAzDoCollector(azDoConfig{
+		AzDoClient:       azdo.AzDoClient{Client: server.Client(), Name: "test", Address: server.URL},
+		ScrapeTimeout:    time.Minute,
+		Concurrency:      1,
+		WatermarkOverlap: 10 * time.Minute,
+		LedgerTTL:        2 * time.Hour,
+	}, nil, nil, time.Minute)
+	azc.pool.start(t.Context())
+	azc.watermarks["project"] = ledgerStart
+
+	// The detail of the build can't be retrieved by the poll it finished in
+	followedUp := []int{}
+	azc.followUps["detail"] = func(ctx context.Context, project azdo.Project, build azdo.Build) error {
+		if len(followedUp) == 0 {
+			followedUp = append(followedUp, 0)
+			return &azdo.RequestError{Kind: azdo.ErrorKindServer, Err: errors.New("unavailable")}
+		}
+		followedUp = append(followedUp, build.Id)
+		return nil
+	}
+
+	poll := func() []int {
+		ids := []int{}
+		for mc := range azc.scrapeBuilds(t.Context(), []azdo.Project{{Name: "project"}}) {
+			ids = append(ids, buildIds(mc.Builds)...)
+		}
+		return ids
+	}
+
+	if ids := poll(); !equalIds(ids, []int{1}) {
+		t.Errorf("first poll admitted %v, want [1]", ids)
+	}
+
+	// The build is only counted once, but is followed up again by the next poll
+	if ids := poll(); len(ids) != 0 {
+		t.Errorf("second poll admitted %v, want none", ids)
+	}
+	if !equalIds(followedUp, []int{0, 1}) {
+		t.Errorf("followed up %v, want a failed attempt then build 1", followedUp)
+	}
+
+	poll()
+	if len(followedUp) != 2 {
+		t.Errorf("followed up %v, want build 1 followed up once it succeeded", followedUp)
+	}
+}
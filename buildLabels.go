@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+// The branches kept as they are when keepBranches isn't set, every other branch is collapsed
+var keepBranchesDefault = []string{"main", "master", "release/*"}
+
+// buildLabels are the optional labels of the build results and durations: the reason a build
+// was run and its normalized branch
+type buildLabels struct {
+	reason       bool
+	branch       bool
+	keepBranches []string // path.Match patterns of the branch names, without refs/heads/, that are kept
+}
+
+func newBuildLabels(server azDoConfig) buildLabels {
+	keepBranches := server.KeepBranches
+	if len(keepBranches) == 0 {
+		keepBranches = keepBranchesDefault
+	}
+
+	return buildLabels{reason: server.ReasonLabel, branch: server.BranchLabel, keepBranches: keepBranches}
+}
+
+// names returns the names of the labels that are turned on
+func (bl buildLabels) names() []string {
+	names := []string{}
+	if bl.reason {
+		names = append(names, "reason")
+	}
+	if bl.branch {
+		names = append(names, "branch")
+	}
+	return names
+}
+
+// values returns the values of the labels that are turned on for the build
+func (bl buildLabels) values(build azdo.Build) []string {
+	values := []string{}
+	if bl.reason {
+		values = append(values, build.Reason)
+	}
+	if bl.branch {
+		values = append(values, bl.normalizeBranch(build.SourceBranch))
+	}
+	return values
+}
+
+// normalizeBranch keeps the branches matching one of the patterns, collapses pull requests into
+// pull_request and every other branch into other, so the number of series stays bounded
+func (bl buildLabels) normalizeBranch(sourceBranch string) string {
+	if strings.HasPrefix(sourceBranch, "refs/pull/") {
+		return "pull_request"
+	}
+
+	branch := strings.TrimPrefix(sourceBranch, "refs/heads/")
+	for _, pattern := range bl.keepBranches {
+		if matched, _ := path.Match(pattern, branch); matched {
+			return branch
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestNormalizeBranch(t *testing.T) {
+	defaults := newBuildLabels(azDoConfig{BranchLabel: true})
+	custom := newBuildLabels(azDoConfig{BranchLabel: true, KeepBranches: []string{"develop", "hotfix/*", "refs/tags/v*"}})
+
+	tests := []struct {
+		name         string
+		labels       buildLabels
+		sourceBranch string
+		want         string
+	}{
+		{name: "main", labels: defaults, sourceBranch: "refs/heads/main", want: "main"},
+		{name: "master", labels: defaults, sourceBranch: "refs/heads/master", want: "master"},
+		{name: "release branch", labels: defaults, sourceBranch: "refs/heads/release/2024.1", want: "release/2024.1"},
+		{name: "nested release branch", labels: defaults, sourceBranch: "refs/heads/release/2024/1", want: "other"},
+		{name: "feature branch", labels: defaults, sourceBranch: "refs/heads/feature/login", want: "other"},
+		{name: "pull request", labels: defaults, sourceBranch: "refs/pull/123/merge", want: "pull_request"},
+		{name: "tag", labels: defaults, sourceBranch: "refs/tags/v1.0.0", want: "other"},
+		{name: "tfvc path", labels: defaults, sourceBranch: "$/Project/Main", want: "other"},
+		{name: "no branch", labels: defaults, sourceBranch: "", want: "other"},
+		{name: "kept branch replaces the defaults", labels: custom, sourceBranch: "refs/heads/main", want: "other"},
+		{name: "kept branch", labels: custom, sourceBranch: "refs/heads/develop", want: "develop"},
+		{name: "kept pattern", labels: custom, sourceBranch: "refs/heads/hotfix/crash", want: "hotfix/crash"},
+		{name: "kept tag", labels: custom, sourceBranch: "refs/tags/v1.0.0", want: "refs/tags/v1.0.0"},
+		{name: "pull request isn't kept", labels: newBuildLabels(azDoConfig{KeepBranches: []string{"*"}}), sourceBranch: "refs/pull/123/merge", want: "pull_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.labels.normalizeBranch(tt.sourceBranch); got != tt.want {
+				t.Errorf("normalizeBranch(%q) is %q, want %q", tt.sourceBranch, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,24 +2,42 @@ package main
 
 import (
 	"net/url"
+	"time"
 
 	"ukho.gov.uk/azdo-build-exporter/azdo"
 )
 
 var (
-	portDefault     = 8080
-	endpointDefault = "/metrics"
+	portDefault               = 8080
+	endpointDefault           = "/metrics"
+	requestTimeoutDefault     = 10 * time.Second
+	scrapeTimeoutDefault      = 25 * time.Second
+	pollIntervalDefault       = 60 * time.Second
+	watermarkOverlapDefault   = 10 * time.Minute
+	ledgerTTLDefault          = 2 * time.Hour
+	agentFailureWindowDefault = time.Hour
+	flakyTestWindowDefault    = 7 * 24 * time.Hour
+	flakyTestTopNDefault      = 20
+	saveIntervalDefault       = time.Minute
+	concurrencyDefault        = 8
 )
 
 type config struct {
 	Servers  map[string]azDoConfig
 	Proxy    proxy
 	Exporter exporter
+	State    stateConfig
+}
+
+type stateConfig struct {
+	Path         string        // Path of the state database file, state isn't saved if empty
+	SaveInterval time.Duration // Minimum time between saves of the state
 }
 
 type exporter struct {
-	Port     int
-	Endpoint string
+	Port        int
+	Endpoint    string
+	Concurrency int // Maximum number of projects polled at once across all servers, unlimited if not set
 }
 
 type proxy struct {
@@ -29,5 +47,31 @@ type proxy struct {
 
 type azDoConfig struct {
 	azdo.AzDoClient
-	UseProxy bool
+	UseProxy       bool
+	RequestTimeout time.Duration // Deadline of a single HTTP request to the server
+	ScrapeTimeout  time.Duration // Deadline for collecting all the metrics of the server
+	PollInterval   time.Duration // Time between polls of the server
+	Concurrency    int           // Maximum number of projects of the server polled at once
+
+	WatermarkOverlap time.Duration // How far before the watermark finished builds are requested again
+	LedgerTTL        time.Duration // How long a finished build is remembered after it was last returned
+
+	HistogramsByDefinition bool          // Label the build duration histograms with the definition as well as the project
+	ReasonLabel            bool          // Label the build results and durations with the reason the build was run
+	BranchLabel            bool          // Label the build results and durations with the normalized branch of the build
+	KeepBranches           []string      // Patterns of the branches kept by the branch label, every other branch is collapsed
+	AgentPools             bool          // Collect the capacity of the agent pools and their agents
+	JobRequests            bool          // Collect the queue of jobs waiting for each agent pool
+	TimelineDefinitions    []int         // Definitions to collect the stages, jobs and tasks of finished builds for
+	TaskFailures           bool          // Attribute the failed tasks of every failed build to the task that was run
+	AgentJobs              bool          // Attribute the jobs of every finished build to the agent that ran them
+	AgentFailureWindow     time.Duration // How far back the jobs of an agent count towards its failure ratio
+	Environments           bool          // Collect the deployments to the YAML environments of each project
+	Releases               bool          // Collect the deployments and approvals of the classic releases of each project
+	Dora                   doraConfig    // Which deployments to YAML environments count as production deployments
+	TestRuns               bool          // Collect the outcomes of the tests run by each finished build
+	FlakyTests             bool          // Flag the tests that pass and fail on the same commit, implies TestRuns
+	FlakyTestWindow        time.Duration // How long commits and flaky tests are remembered after they were last seen
+	FlakyTestTopN          int           // Number of the flakiest tests published
+	CoverageBranches       []string      // Branches to collect the code coverage of finished builds for
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	coveragePercentDesc = prometheus.NewDesc(
+		"azdo_code_coverage_percent",
+		"Percentage of the code covered by the tests of the last finished build of the definition on the branch",
+		[]string{"project", "definition", "branch", "type"},
+		nil,
+	)
+
+	coverageCoveredDesc = prometheus.NewDesc(
+		"azdo_code_coverage_covered",
+		"Number of lines or branches covered by the tests of the last finished build of the definition on the branch",
+		[]string{"project", "definition", "branch", "type"},
+		nil,
+	)
+
+	coverageTotalDesc = prometheus.NewDesc(
+		"azdo_code_coverage_total",
+		"Number of lines or branches of the last finished build of the definition on the branch",
+		[]string{"project", "definition", "branch", "type"},
+		nil,
+	)
+)
+
+// The coverage statistics published, by their label in the summary, and the type they are published as
+var coverageTypes = map[string]string{
+	"Lines":    "lines",
+	"Branches": "branches",
+}
+
+// coverageMetrics hold the code coverage of the last finished build of each definition on the configured branches
+type coverageMetrics struct {
+	branches []string
+
+	lock   sync.Mutex
+	latest map[string]buildCoverage // By labelKey of project, definition and branch
+}
+
+type buildCoverage struct {
+	LabelValues []string
+	FinishTime  time.Time
+	Covered     map[string]int // By type
+	Total       map[string]int // By type
+}
+
+func newCoverageMetrics(branches []string) *coverageMetrics {
+	return &coverageMetrics{branches: branches, latest: make(map[string]buildCoverage)}
+}
+
+// wants reports if the coverage of the build should be retrieved
+func (cm *coverageMetrics) wants(build azdo.Build) bool {
+	branch := strings.TrimPrefix(build.SourceBranch, "refs/heads/")
+	for _, wanted := range cm.branches {
+		if strings.EqualFold(strings.TrimPrefix(wanted, "refs/heads/"), branch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe keeps the coverage of a finished build, if it is newer than the coverage already held
+func (cm *coverageMetrics) Observe(project azdo.Project, build azdo.Build, summary azdo.CodeCoverageSummary) {
+	coverage := buildCoverage{
+		LabelValues: []string{project.Name, build.Definition.Name, strings.TrimPrefix(build.SourceBranch, "refs/heads/")},
+		FinishTime:  build.FinishTime,
+		Covered:     make(map[string]int),
+		Total:       make(map[string]int),
+	}
+
+	// Builds for more than one flavour or platform have coverage for each, they are added together
+	for _, data := range summary.CoverageData {
+		for _, statistic := range data.CoverageStats {
+			coverageType, ok := coverageTypes[statistic.Label]
+			if !ok {
+				continue
+			}
+			coverage.Covered[coverageType] += statistic.Covered
+			coverage.Total[coverageType] += statistic.Total
+		}
+	}
+
+	// Builds that don't publish coverage leave the coverage of the last build that did
+	if len(coverage.Total) == 0 {
+		return
+	}
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	key := labelKey(coverage.LabelValues)
+	if last, ok := cm.latest[key]; ok && last.FinishTime.After(build.FinishTime) {
+		return
+	}
+	cm.latest[key] = coverage
+}
+
+// Collect publishes the coverage timestamped with the finish time of the build it is of
+func (cm *coverageMetrics) Collect(ch chan<- prometheus.Metric) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	keys := make([]string, 0, len(cm.latest))
+	for key := range cm.latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		coverage := cm.latest[key]
+		for coverageType, total := range coverage.Total {
+			labelValues := append(append([]string{}, coverage.LabelValues...), coverageType)
+			covered := coverage.Covered[coverageType]
+
+			percent := 0.0
+			if total > 0 {
+				percent = 100 * float64(covered) / float64(total)
+			}
+
+			ch <- prometheus.NewMetricWithTimestamp(coverage.FinishTime, prometheus.MustNewConstMetric(coveragePercentDesc, prometheus.GaugeValue, percent, labelValues...))
+			ch <- prometheus.NewMetricWithTimestamp(coverage.FinishTime, prometheus.MustNewConstMetric(coverageCoveredDesc, prometheus.GaugeValue, float64(covered), labelValues...))
+			ch <- prometheus.NewMetricWithTimestamp(coverage.FinishTime, prometheus.MustNewConstMetric(coverageTotalDesc, prometheus.GaugeValue, float64(total), labelValues...))
+		}
+	}
+}
+
+// followUpCoverage retrieves the code coverage of a newly finished build, if it is of one of the configured branches
+func (azc *azDoCollector) followUpCoverage(ctx context.Context, project azdo.Project, build azdo.Build) error {
+	if !azc.coverage.wants(build) {
+		return nil
+	}
+
+	summary, err := azc.AzDoClient.GetCodeCoverage(ctx, project.Name, build.Id)
+	if err != nil {
+		azc.recordError(project.Name, err)
+		return err
+	}
+
+	azc.coverage.Observe(project, build, summary)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelKey joins label values into a single map key
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// counterSet holds monotonic counters that accumulate across polls, one per set of label values
+type counterSet struct {
+	desc   *prometheus.Desc
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	LabelValues []string
+	Value       float64
+}
+
+func newCounterSet(desc *prometheus.Desc) *counterSet {
+	return &counterSet{desc: desc, values: make(map[string]*counterValue)}
+}
+
+// Add increases the counter for the label values by v, creating it if needed
+func (c *counterSet) Add(v float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := labelKey(labelValues)
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{LabelValues: labelValues}
+		c.values[key] = value
+	}
+	value.Value += v
+}
+
+// Collect publishes every counter in the set
+func (c *counterSet) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, value := range c.sorted() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, value.Value, value.LabelValues...)
+	}
+}
+
+// snapshot returns a copy of every counter in the set
+func (c *counterSet) snapshot() []*counterValue {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	values := make([]*counterValue, 0, len(c.values))
+	for _, value := range c.sorted() {
+		copied := *value
+		values = append(values, &copied)
+	}
+	return values
+}
+
+// restore adds counters saved by snapshot to the set. Counters saved with different labels,
+// because optional labels have been turned on or off since, can't be merged and are dropped.
+func (c *counterSet) restore(values []*counterValue) int {
+	dropped := 0
+	for _, value := range values {
+		if _, err := prometheus.NewConstMetric(c.desc, prometheus.CounterValue, value.Value, value.LabelValues...); err != nil {
+			dropped++
+			continue
+		}
+		c.Add(value.Value, value.LabelValues...)
+	}
+	return dropped
+}
+
+func (c *counterSet) sorted() []*counterValue {
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]*counterValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, c.values[key])
+	}
+	return values
+}
+
+// histogramSet holds histograms that accumulate observations across polls, one per set of label values
+type histogramSet struct {
+	desc    *prometheus.Desc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	LabelValues  []string
+	Count        uint64
+	Sum          float64
+	BucketCounts []uint64  // Observations falling in each bucket, not cumulative
+	UpperBounds  []float64 // Of the buckets, only set on the copies returned by snapshot
+}
+
+func newHistogramSet(desc *prometheus.Desc, buckets []float64) *histogramSet {
+	return &histogramSet{desc: desc, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+// Observe adds a single observation to the histogram for the label values, creating it if needed
+func (h *histogramSet) Observe(v float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	key := labelKey(labelValues)
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{LabelValues: labelValues, BucketCounts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+
+	value.Count++
+	value.Sum += v
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		value.BucketCounts[i]++
+	}
+}
+
+// snapshot returns a copy of every histogram in the set
+func (h *histogramSet) snapshot() []*histogramValue {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	values := make([]*histogramValue, 0, len(h.values))
+	for _, value := range h.values {
+		copied := *value
+		copied.BucketCounts = append([]uint64{}, value.BucketCounts...)
+		copied.UpperBounds = append([]float64{}, h.buckets...)
+		values = append(values, &copied)
+	}
+	return values
+}
+
+// restore adds histograms saved by snapshot to the set. Histograms saved with different
+// buckets or labels can't be merged and are dropped.
+func (h *histogramSet) restore(values []*histogramValue) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	dropped := 0
+	for _, saved := range values {
+		if !equalBuckets(saved.UpperBounds, h.buckets) || len(saved.BucketCounts) != len(h.buckets) {
+			dropped++
+			continue
+		}
+		if _, err := prometheus.NewConstHistogram(h.desc, 0, 0, nil, saved.LabelValues...); err != nil {
+			dropped++
+			continue
+		}
+
+		key := labelKey(saved.LabelValues)
+		value, ok := h.values[key]
+		if !ok {
+			value = &histogramValue{LabelValues: saved.LabelValues, BucketCounts: make([]uint64, len(h.buckets))}
+			h.values[key] = value
+		}
+
+		value.Count += saved.Count
+		value.Sum += saved.Sum
+		for i, count := range saved.BucketCounts {
+			value.BucketCounts[i] += count
+		}
+	}
+	return dropped
+}
+
+// equalBuckets reports if the upper bounds of two sets of buckets are the same
+func equalBuckets(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect publishes every histogram in the set
+func (h *histogramSet) Collect(ch chan<- prometheus.Metric) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := h.values[key]
+
+		buckets := make(map[float64]uint64, len(h.buckets))
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += value.BucketCounts[i]
+			buckets[upperBound] = cumulative
+		}
+
+		ch <- prometheus.MustNewConstHistogram(h.desc, value.Count, value.Sum, buckets, value.LabelValues...)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var restoreDesc = prometheus.NewDesc("test_duration_seconds", "Duration of tests", []string{"project"}, nil)
+
+func TestHistogramSetRestore(t *testing.T) {
+	tests := []struct {
+		name        string
+		savedDesc   *prometheus.Desc
+		savedBounds []float64
+		wantDropped int
+		wantCount   uint64
+	}{
+		{name: "same buckets", savedDesc: restoreDesc, savedBounds: []float64{1, 2, 4}, wantCount: 2},
+		{name: "different bounds", savedDesc: restoreDesc, savedBounds: []float64{1, 3, 9}, wantDropped: 1, wantCount: 1},
+		{name: "different number of buckets", savedDesc: restoreDesc, savedBounds: []float64{1, 2}, wantDropped: 1, wantCount: 1},
+		{
+			name:        "different labels",
+			savedDesc:   prometheus.NewDesc("test_duration_seconds", "Duration of tests", []string{"project", "definition"}, nil),
+			savedBounds: []float64{1, 2, 4},
+			wantDropped: 1,
+			wantCount:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := newHistogramSet(tt.savedDesc, tt.savedBounds)
+			labelValues := []string{"project"}
+			if tt.savedDesc != restoreDesc {
+				labelValues = append(labelValues, "definition")
+			}
+			saved.Observe(1.5, labelValues...)
+
+			h := newHistogramSet(restoreDesc, []float64{1, 2, 4})
+			h.Observe(3, "project")
+
+			if dropped := h.restore(saved.snapshot()); dropped != tt.wantDropped {
+				t.Errorf("dropped %d histograms, want %d", dropped, tt.wantDropped)
+			}
+
+			values := h.snapshot()
+			if len(values) != 1 {
+				t.Fatalf("got %d histograms, want 1", len(values))
+			}
+			if values[0].Count != tt.wantCount {
+				t.Errorf("histogram has count %d, want %d", values[0].Count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestCounterSetRestore(t *testing.T) {
+	saved := newCounterSet(restoreDesc)
+	saved.Add(2, "project")
+	saved.Add(1, "project", "extra")
+
+	c := newCounterSet(restoreDesc)
+	c.Add(3, "project")
+
+	if dropped := c.restore(saved.snapshot()); dropped != 1 {
+		t.Errorf("dropped %d counters, want 1", dropped)
+	}
+
+	values := c.snapshot()
+	if len(values) != 1 || values[0].Value != 5 {
+		t.Errorf("got counters %v, want a single counter of 5", values)
+	}
+}
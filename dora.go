@@ -0,0 +1,283 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	doraDeploymentsDesc = prometheus.NewDesc(
+		"azdo_dora_deployments_total",
+		"Total of finished production deployments of the pipeline by result",
+		[]string{"project", "pipeline", "result"},
+		nil,
+	)
+
+	doraChangeFailureRateDesc = prometheus.NewDesc(
+		"azdo_dora_change_failure_rate",
+		"Ratio of the production deployments of the pipeline that failed",
+		[]string{"project", "pipeline"},
+		nil,
+	)
+
+	doraLeadTimeDesc = prometheus.NewDesc(
+		"azdo_dora_lead_time_seconds",
+		"Time from a change being committed to it being deployed to production successfully",
+		[]string{"project", "pipeline"},
+		nil,
+	)
+
+	doraTimeToRestoreDesc = prometheus.NewDesc(
+		"azdo_dora_time_to_restore_seconds",
+		"Time from a production deployment of the pipeline failing to the next one succeeding",
+		[]string{"project", "pipeline"},
+		nil,
+	)
+)
+
+// doraConfig maps which deployments to YAML environments count as production deployments.
+// A deployment counts when it is to one of the environments and, if they are set, from one
+// of the pipelines and stages.
+type doraConfig struct {
+	Environments []string // Names of the production environments, DORA metrics aren't collected if empty
+	Pipelines    []string // Names of the pipelines deploying to production, all pipelines if empty
+	Stages       []string // Names of the stages deploying to production, all stages if empty
+}
+
+func (c doraConfig) enabled() bool {
+	return len(c.Environments) > 0
+}
+
+// doraMetrics calculate the four key DORA metrics of each pipeline from its production deployments
+type doraMetrics struct {
+	config doraConfig
+
+	// shipped remembers the runs whose changes have already been observed, as a run can be deployed to
+	// more than one production environment
+	shipped *seenLedger
+
+	deployments  *counterSet
+	leadTimes    *histogramSet
+	restoreTimes *histogramSet
+
+	// failingSince holds when production deployments of a pipeline started failing, and lastShipped the
+	// last run of a pipeline deployed to production, by labelKey of project and pipeline
+	lock         sync.Mutex
+	failingSince map[string]time.Time
+	lastShipped  map[string]int
+}
+
+// shipment is a successful production deployment whose lead time is still to be observed, along with
+// the run of the pipeline last deployed to production before it, 0 if it isn't known
+type shipment struct {
+	Record    azdo.DeploymentRecord
+	FromRunId int
+}
+
+func newDoraMetrics(config doraConfig, ledgerTTL time.Duration) *doraMetrics {
+	return &doraMetrics{
+		config:       config,
+		shipped:      newSeenLedger(ledgerTTL),
+		deployments:  newCounterSet(doraDeploymentsDesc),
+		leadTimes:    newHistogramSet(doraLeadTimeDesc, prometheus.ExponentialBuckets(600, 2, 14)),      // 10 minutes up to ~57 days
+		restoreTimes: newHistogramSet(doraTimeToRestoreDesc, prometheus.ExponentialBuckets(300, 2, 12)), // 5 minutes up to ~7 days
+		failingSince: make(map[string]time.Time),
+		lastShipped:  make(map[string]int),
+	}
+}
+
+// isProduction reports if a deployment to the environment counts as a production deployment
+func (dm *doraMetrics) isProduction(environment azdo.Environment, record azdo.DeploymentRecord) bool {
+	return containsFold(dm.config.Environments, environment.Name) &&
+		(len(dm.config.Pipelines) == 0 || containsFold(dm.config.Pipelines, record.Definition.Name)) &&
+		(len(dm.config.Stages) == 0 || containsFold(dm.config.Stages, record.StageName))
+}
+
+// Observe accounts for newly finished deployments to an environment, returning the successful
+// production deployments whose lead time is still to be observed
+func (dm *doraMetrics) Observe(project azdo.Project, environment azdo.Environment, records []azdo.DeploymentRecord, now time.Time) []shipment {
+	if !dm.config.enabled() {
+		return nil
+	}
+
+	production := []azdo.DeploymentRecord{}
+	for _, record := range records {
+		if dm.isProduction(environment, record) {
+			production = append(production, record)
+		}
+	}
+
+	// Restores are worked out in the order the deployments finished
+	sort.Slice(production, func(i, j int) bool {
+		return production[i].FinishTime.Before(production[j].FinishTime)
+	})
+
+	shipments := []shipment{}
+	for _, record := range production {
+		switch record.Result {
+		case "succeeded", "succeededWithIssues":
+			dm.deployments.Add(1, project.Name, record.Definition.Name, "succeeded")
+			dm.restored(project, record)
+			if dm.shipped.admitOnce(project.Name, record.Owner.Id, time.Time{}, now) {
+				if s, ok := dm.ship(project, record); ok {
+					shipments = append(shipments, s)
+				}
+			}
+		case "failed":
+			dm.deployments.Add(1, project.Name, record.Definition.Name, "failed")
+			dm.failed(project, record)
+		}
+	}
+	return shipments
+}
+
+// ship records the run of the deployment as the last run of its pipeline deployed to production. A run
+// older than the last one deployed, such as a rollback, ships no new changes so it isn't returned.
+func (dm *doraMetrics) ship(project azdo.Project, record azdo.DeploymentRecord) (shipment, bool) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	key := labelKey([]string{project.Name, record.Definition.Name})
+	last := dm.lastShipped[key]
+	if last >= record.Owner.Id {
+		return shipment{}, false
+	}
+
+	dm.lastShipped[key] = record.Owner.Id
+	return shipment{Record: record, FromRunId: last}, true
+}
+
+func (dm *doraMetrics) failed(project azdo.Project, record azdo.DeploymentRecord) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	key := labelKey([]string{project.Name, record.Definition.Name})
+	if _, ok := dm.failingSince[key]; !ok {
+		dm.failingSince[key] = record.FinishTime
+	}
+}
+
+func (dm *doraMetrics) restored(project azdo.Project, record azdo.DeploymentRecord) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	key := labelKey([]string{project.Name, record.Definition.Name})
+	since, ok := dm.failingSince[key]
+	if !ok {
+		return
+	}
+
+	delete(dm.failingSince, key)
+	if record.FinishTime.After(since) {
+		dm.restoreTimes.Observe(record.FinishTime.Sub(since).Seconds(), project.Name, record.Definition.Name)
+	}
+}
+
+// ObserveChanges observes the lead time of each change shipped by a successful production deployment,
+// the changes built by the runs since the last run of the pipeline deployed to production
+func (dm *doraMetrics) ObserveChanges(project azdo.Project, record azdo.DeploymentRecord, changes []azdo.Change) {
+	for _, change := range changes {
+		if change.Timestamp.IsZero() || change.Timestamp.After(record.FinishTime) {
+			continue
+		}
+		dm.leadTimes.Observe(record.FinishTime.Sub(change.Timestamp).Seconds(), project.Name, record.Definition.Name)
+	}
+}
+
+func (dm *doraMetrics) Collect(ch chan<- prometheus.Metric) {
+	dm.deployments.Collect(ch)
+	dm.leadTimes.Collect(ch)
+	dm.restoreTimes.Collect(ch)
+
+	// The change failure rate over every deployment counted, rate() the counters for a window
+	type deployments struct {
+		labelValues []string
+		total       float64
+		failed      float64
+	}
+	byPipeline := make(map[string]*deployments)
+	keys := []string{}
+	for _, value := range dm.deployments.snapshot() {
+		pipeline := value.LabelValues[:2]
+		key := labelKey(pipeline)
+		d, ok := byPipeline[key]
+		if !ok {
+			d = &deployments{labelValues: pipeline}
+			byPipeline[key] = d
+			keys = append(keys, key)
+		}
+		d.total += value.Value
+		if value.LabelValues[2] == "failed" {
+			d.failed += value.Value
+		}
+	}
+
+	for _, key := range keys {
+		d := byPipeline[key]
+		ch <- prometheus.MustNewConstMetric(doraChangeFailureRateDesc, prometheus.GaugeValue, d.failed/d.total, d.labelValues...)
+	}
+}
+
+// snapshotFailing returns a copy of when the pipelines currently failing started failing
+func (dm *doraMetrics) snapshotFailing() map[string]time.Time {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	failing := make(map[string]time.Time, len(dm.failingSince))
+	for key, since := range dm.failingSince {
+		failing[key] = since
+	}
+	return failing
+}
+
+// snapshotShipped returns a copy of the last run of each pipeline deployed to production
+func (dm *doraMetrics) snapshotShipped() map[string]int {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	shipped := make(map[string]int, len(dm.lastShipped))
+	for key, runId := range dm.lastShipped {
+		shipped[key] = runId
+	}
+	return shipped
+}
+
+// restoreShipped adds the runs saved by snapshotShipped
+func (dm *doraMetrics) restoreShipped(shipped map[string]int) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	for key, runId := range shipped {
+		if runId > dm.lastShipped[key] {
+			dm.lastShipped[key] = runId
+		}
+	}
+}
+
+// restoreFailing adds the failing pipelines saved by snapshotFailing
+func (dm *doraMetrics) restoreFailing(failing map[string]time.Time) {
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+
+	for key, since := range failing {
+		if _, ok := dm.failingSince[key]; !ok {
+			dm.failingSince[key] = since
+		}
+	}
+}
+
+// containsFold reports if the value is in the list, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func productionDeployment(id int, runId int, finished time.Duration) azdo.DeploymentRecord {
+	return azdo.DeploymentRecord{
+		Id:         id,
+		Result:     "succeeded",
+		FinishTime: ledgerStart.Add(finished),
+		Definition: azdo.Definition{Name: "deploy"},
+		Owner:      azdo.RunOwner{Id: runId},
+	}
+}
+
+func TestDoraMetricsShipments(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	production := azdo.Environment{Id: 1, Name: "production"}
+	dm := newDoraMetrics(doraConfig{Environments: []string{"production", "production-eu"}}, 2*time.Hour)
+
+	tests := []struct {
+		name        string
+		environment azdo.Environment
+		records     []azdo.DeploymentRecord
+		want        []shipment
+	}{
+		{
+			name:        "first run deployed",
+			environment: production,
+			records:     []azdo.DeploymentRecord{productionDeployment(1, 10, time.Minute)},
+			want:        []shipment{{FromRunId: 0}},
+		},
+		{
+			name:        "runs in the order they finished",
+			environment: production,
+			records:     []azdo.DeploymentRecord{productionDeployment(3, 20, 3*time.Minute), productionDeployment(2, 15, 2*time.Minute)},
+			want:        []shipment{{FromRunId: 10}, {FromRunId: 15}},
+		},
+		{
+			name:        "same run to another production environment",
+			environment: azdo.Environment{Id: 2, Name: "production-eu"},
+			records:     []azdo.DeploymentRecord{productionDeployment(4, 20, 4*time.Minute)},
+		},
+		{
+			name:        "rollback to an older run",
+			environment: production,
+			records:     []azdo.DeploymentRecord{productionDeployment(5, 15, 5*time.Minute)},
+		},
+		{
+			name:        "next run after a rollback",
+			environment: production,
+			records:     []azdo.DeploymentRecord{productionDeployment(6, 25, 6*time.Minute)},
+			want:        []shipment{{FromRunId: 20}},
+		},
+	}
+
+	for _, tt := range tests {
+		got := dm.Observe(project, tt.environment, tt.records, ledgerStart.Add(10*time.Minute))
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %d shipments, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i := range got {
+			if got[i].FromRunId != tt.want[i].FromRunId {
+				t.Errorf("%s: shipment %d of run %d is from run %d, want %d", tt.name, i, got[i].Record.Owner.Id, got[i].FromRunId, tt.want[i].FromRunId)
+			}
+		}
+	}
+}
+
+func TestChangesShipped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch r.URL.Path {
+		case "/project/_apis/build/changes":
+			if query.Get("fromBuildId") != "10" || query.Get("toBuildId") != "20" || query.Get("api-version") != "6.0-preview.2" {
+				t.Errorf("unexpected query %v", query)
+			}
+			fmt.Fprint(w, `{"count": 2, "value": [{"id": "b"}, {"id": "a"}]}`)
+		case "/project/_apis/build/builds/20/changes":
+			fmt.Fprint(w, `{"count": 1, "value": [{"id": "b"}]}`)
+		default:
+			t.Errorf("unexpected request for %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	azc := newAzDoCollector(azDoConfig{
+		AzDoClient: azdo.AzDoClient{Client: server.Client(), Name: "test", Address: server.URL},
+		Dora:       doraConfig{Environments: []string{"production"}},
+	}, nil, nil, time.Minute)
+	project := azdo.Project{Name: "project"}
+
+	tests := []struct {
+		name      string
+		fromRunId int
+		want      int
+	}{
+		{name: "since the last run deployed", fromRunId: 10, want: 2},
+		{name: "last run deployed not known", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := azc.changesShipped(t.Context(), project, shipment{Record: productionDeployment(1, 20, time.Minute), FromRunId: tt.fromRunId})
+			if err != nil {
+				t.Fatalf("changesShipped returned an error: %v", err)
+			}
+			if len(changes) != tt.want {
+				t.Errorf("got %d changes, want %d", len(changes), tt.want)
+			}
+		})
+	}
+}
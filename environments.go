@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	environmentDeploymentsDesc = prometheus.NewDesc(
+		"azdo_environment_deployments_total",
+		"Total of finished deployments to the environment by result",
+		[]string{"project", "environment", "pipeline", "result"},
+		nil,
+	)
+
+	environmentDeploymentDurationDesc = prometheus.NewDesc(
+		"azdo_environment_deployment_duration_seconds",
+		"Duration of finished deployments to the environment",
+		[]string{"project", "environment", "pipeline"},
+		nil,
+	)
+
+	environmentLastSuccessAgeDesc = prometheus.NewDesc(
+		"azdo_environment_last_successful_deployment_age_seconds",
+		"Time since the last successful deployment to the environment finished",
+		[]string{"project", "environment", "pipeline"},
+		nil,
+	)
+)
+
+// Number of the most recent deployment records retrieved for each environment on every poll
+const deploymentRecordCount = 200
+
+// environmentMetrics accumulate the deployments made to the YAML environments of each project. When the
+// deployments are only retrieved for the DORA metrics they are admitted to the ledger but not published.
+type environmentMetrics struct {
+	enabled   bool
+	ledger    *seenLedger
+	results   *counterSet
+	durations *histogramSet
+
+	// lastSuccess holds the finish time of the last successful deployment, by labelKey of project, environment and pipeline
+	lock        sync.Mutex
+	lastSuccess map[string]lastDeployment
+}
+
+type lastDeployment struct {
+	LabelValues []string
+	FinishTime  time.Time
+}
+
+func newEnvironmentMetrics(enabled bool, ledgerTTL time.Duration) *environmentMetrics {
+	return &environmentMetrics{
+		enabled:     enabled,
+		ledger:      newSeenLedger(ledgerTTL),
+		results:     newCounterSet(environmentDeploymentsDesc),
+		durations:   newHistogramSet(environmentDeploymentDurationDesc, prometheus.ExponentialBuckets(1, 2, 15)), // 1 second up to ~4.5 hours
+		lastSuccess: make(map[string]lastDeployment),
+	}
+}
+
+// Observe accounts for the deployments to an environment that haven't been seen yet, returning them.
+// The deployments returned by the first poll of an environment finished before the exporter started,
+// so they only seed the ledger.
+func (em *environmentMetrics) Observe(project azdo.Project, environment azdo.Environment, records []azdo.DeploymentRecord, now time.Time) []azdo.DeploymentRecord {
+	scope := project.Name + "/" + strconv.Itoa(environment.Id)
+	firstPoll := em.ledger.firstPoll(scope)
+
+	admitted := []azdo.DeploymentRecord{}
+	for _, record := range records {
+		// Deployments still running have no result yet
+		if record.Result == "" || record.FinishTime.IsZero() {
+			continue
+		}
+
+		labelValues := []string{project.Name, environment.Name, record.Definition.Name}
+		if em.enabled && record.Result == "succeeded" {
+			em.succeeded(labelValues, record.FinishTime)
+		}
+
+		if !em.ledger.admitOnce(scope, record.Id, record.FinishTime, now) || firstPoll {
+			continue
+		}
+		admitted = append(admitted, record)
+
+		if !em.enabled {
+			continue
+		}
+		em.results.Add(1, append(labelValues, record.Result)...)
+		if !record.StartTime.IsZero() {
+			em.durations.Observe(record.FinishTime.Sub(record.StartTime).Seconds(), labelValues...)
+		}
+	}
+	return admitted
+}
+
+func (em *environmentMetrics) succeeded(labelValues []string, finishTime time.Time) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	key := labelKey(labelValues)
+	if last, ok := em.lastSuccess[key]; !ok || finishTime.After(last.FinishTime) {
+		em.lastSuccess[key] = lastDeployment{LabelValues: labelValues, FinishTime: finishTime}
+	}
+}
+
+func (em *environmentMetrics) Collect(ch chan<- prometheus.Metric) {
+	if !em.enabled {
+		return
+	}
+
+	em.results.Collect(ch)
+	em.durations.Collect(ch)
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	keys := make([]string, 0, len(em.lastSuccess))
+	for key := range em.lastSuccess {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, key := range keys {
+		last := em.lastSuccess[key]
+		ch <- prometheus.MustNewConstMetric(environmentLastSuccessAgeDesc, prometheus.GaugeValue, now.Sub(last.FinishTime).Seconds(), last.LabelValues...)
+	}
+}
+
+// scrapeEnvironments retrieves the most recent deployments to every environment of each project
+func (azc *azDoCollector) scrapeEnvironments(ctx context.Context, projects []azdo.Project) []prometheus.Metric {
+	var wg sync.WaitGroup
+
+	for _, project := range projects {
+		wg.Add(1)
+		p := project
+		azc.pool.submit(p.Name, func() {
+			defer wg.Done()
+
+			environments, err := azc.AzDoClient.GetEnvironments(ctx, p.Name)
+			if err != nil {
+				azc.recordError(p.Name, err)
+				return
+			}
+
+			// Queued behind the other projects, rather than run here, so each project gets its turn
+			for _, environment := range environments {
+				wg.Add(1)
+				e := environment
+				azc.pool.submit(p.Name, func() {
+					defer wg.Done()
+
+					records, err := azc.AzDoClient.GetDeploymentRecords(ctx, p.Name, e.Id, deploymentRecordCount)
+					if err != nil {
+						azc.recordError(p.Name, err)
+						return
+					}
+					admitted := azc.environments.Observe(p, e, records, time.Now())
+
+					// The lead time of each production deployment needs the commits it shipped
+					for _, s := range azc.dora.Observe(p, e, admitted, time.Now()) {
+						wg.Add(1)
+						shipped := s
+						azc.pool.submit(p.Name, func() {
+							defer wg.Done()
+
+							changes, err := azc.changesShipped(ctx, p, shipped)
+							if err != nil {
+								azc.recordError(p.Name, err)
+								return
+							}
+							azc.dora.ObserveChanges(p, shipped.Record, changes)
+						})
+					}
+				})
+			}
+		})
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// changesShipped retrieves the changes built by the runs of the pipeline since the run last deployed to
+// production. If that run isn't known only the changes of the deployed run itself are retrieved.
+func (azc *azDoCollector) changesShipped(ctx context.Context, project azdo.Project, shipped shipment) ([]azdo.Change, error) {
+	if shipped.FromRunId == 0 {
+		return azc.AzDoClient.GetBuildChanges(ctx, project.Name, shipped.Record.Owner.Id)
+	}
+	return azc.AzDoClient.GetChangesBetweenBuilds(ctx, project.Name, shipped.FromRunId, shipped.Record.Owner.Id)
+}
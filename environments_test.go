@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestEnvironmentMetricsFirstPoll(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	environment := azdo.Environment{Id: 1, Name: "production"}
+	deployment := func(id int, finished time.Duration) azdo.DeploymentRecord {
+		return azdo.DeploymentRecord{
+			Id:         id,
+			Result:     "succeeded",
+			StartTime:  ledgerStart,
+			FinishTime: ledgerStart.Add(finished),
+			Definition: azdo.Definition{Name: "deploy"},
+		}
+	}
+	deployed := func(em *environmentMetrics) float64 {
+		total := 0.0
+		for _, value := range em.results.snapshot() {
+			total += value.Value
+		}
+		return total
+	}
+
+	em := newEnvironmentMetrics(true, 2*time.Hour)
+
+	// The deployments made before the exporter started only seed the ledger
+	records := []azdo.DeploymentRecord{deployment(2, 2*time.Minute), deployment(1, time.Minute)}
+	if admitted := em.Observe(project, environment, records, ledgerStart.Add(5*time.Minute)); len(admitted) != 0 {
+		t.Errorf("first poll admitted %d deployments, want 0", len(admitted))
+	}
+	if got := deployed(em); got != 0 {
+		t.Errorf("first poll counted %v deployments, want 0", got)
+	}
+
+	// Only the deployment made since is counted by the next poll
+	records = append([]azdo.DeploymentRecord{deployment(3, 6*time.Minute)}, records...)
+	if admitted := em.Observe(project, environment, records, ledgerStart.Add(10*time.Minute)); len(admitted) != 1 || admitted[0].Id != 3 {
+		t.Errorf("second poll admitted %v, want deployment 3", admitted)
+	}
+	if got := deployed(em); got != 1 {
+		t.Errorf("second poll counted %v deployments in all, want 1", got)
+	}
+
+	// An environment with deployments restored from the saved state is counted from its first poll
+	restored := newEnvironmentMetrics(true, 2*time.Hour)
+	restored.ledger.restore(map[string]map[int]ledgerEntry{"project/1": {1: {FinishTime: ledgerStart.Add(time.Minute), LastSeen: ledgerStart}}})
+	if admitted := restored.Observe(project, environment, records, ledgerStart.Add(10*time.Minute)); len(admitted) != 2 {
+		t.Errorf("first poll of a restored environment admitted %d deployments, want 2", len(admitted))
+	}
+}
+
+func TestEnvironmentMetricsOnlyForDora(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	environment := azdo.Environment{Id: 1, Name: "production"}
+	records := []azdo.DeploymentRecord{productionDeployment(1, 10, time.Minute)}
+
+	em := newEnvironmentMetrics(false, 2*time.Hour)
+	em.Observe(project, environment, records, ledgerStart.Add(5*time.Minute))
+
+	// The deployments are still admitted for the DORA metrics, but nothing is published
+	records = append([]azdo.DeploymentRecord{productionDeployment(2, 20, 6*time.Minute)}, records...)
+	if admitted := em.Observe(project, environment, records, ledgerStart.Add(10*time.Minute)); len(admitted) != 1 || admitted[0].Id != 2 {
+		t.Errorf("admitted %v, want deployment 2", admitted)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	em.Collect(ch)
+	close(ch)
+	if published := len(ch); published != 0 {
+		t.Errorf("published %d metrics, want none", published)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	flakyTestsDesc = prometheus.NewDesc(
+		"azdo_flaky_tests",
+		"Number of tests of the definition that flipped between passing and failing on the same commit within the flaky test window",
+		[]string{"project", "definition"},
+		nil,
+	)
+
+	flakyTestFlipsDesc = prometheus.NewDesc(
+		"azdo_flaky_test_flips",
+		"Number of times one of the flakiest tests flipped between passing and failing on the same commit within the flaky test window",
+		[]string{"project", "definition", "test"},
+		nil,
+	)
+
+	testFlakyResultsDesc = prometheus.NewDesc(
+		"azdo_test_flaky_results_total",
+		"Total of the results of tests run by finished builds that AzDO marked as flaky",
+		[]string{"project", "definition"},
+		nil,
+	)
+)
+
+// flakyTestMetrics track the outcome of each test across the builds of a commit, flagging the tests
+// that both pass and fail on the same commit of a definition and branch as flaky
+type flakyTestMetrics struct {
+	window time.Duration
+	topN   int
+
+	markedFlaky *counterSet
+
+	lock    sync.Mutex
+	commits map[string]*commitOutcomes // By labelKey of project, definition, branch and commit
+	flaky   map[string]*flakyTest      // By labelKey of project, definition and test
+}
+
+// commitOutcomes are the outcomes of the tests that failed, or passed after failing, in the builds of a commit
+type commitOutcomes struct {
+	lastSeen time.Time
+	passed   map[string]bool // Whether the test passed the last time it was seen
+	failed   bool            // Whether any test has failed on the commit
+}
+
+type flakyTest struct {
+	LabelValues []string
+	Flips       int
+	LastFlip    time.Time
+}
+
+func newFlakyTestMetrics(window time.Duration, topN int) *flakyTestMetrics {
+	return &flakyTestMetrics{
+		window:      window,
+		topN:        topN,
+		markedFlaky: newCounterSet(testFlakyResultsDesc),
+		commits:     make(map[string]*commitOutcomes),
+		flaky:       make(map[string]*flakyTest),
+	}
+}
+
+func commitKey(project azdo.Project, build azdo.Build) string {
+	return labelKey([]string{project.Name, build.Definition.Name, build.SourceBranch, build.SourceVersion})
+}
+
+// hasFailures reports if tests have failed on an earlier build of the commit of the build
+func (ft *flakyTestMetrics) hasFailures(project azdo.Project, build azdo.Build) bool {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	commit, ok := ft.commits[commitKey(project, build)]
+	return ok && commit.failed
+}
+
+// Observe records the tests that failed and passed in a finished build, flagging those that flipped
+// within the build or against an earlier build of the same commit
+func (ft *flakyTestMetrics) Observe(project azdo.Project, build azdo.Build, failed []string, passed []string, now time.Time) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	key := commitKey(project, build)
+	commit, ok := ft.commits[key]
+	if !ok {
+		commit = &commitOutcomes{passed: make(map[string]bool)}
+		ft.commits[key] = commit
+	}
+	commit.lastSeen = now
+
+	// A flip is a test that failed after passing or passed after failing, a test retried within the
+	// build can do both
+	for _, test := range failed {
+		if lastPassed, ok := commit.passed[test]; ok && lastPassed {
+			ft.flipped(project, build, test, now)
+		}
+		commit.passed[test] = false
+		commit.failed = true
+	}
+	// Only the tests that have failed on the commit are followed, not every test that passed
+	for _, test := range passed {
+		lastPassed, ok := commit.passed[test]
+		if !ok {
+			continue
+		}
+		if !lastPassed {
+			ft.flipped(project, build, test, now)
+		}
+		commit.passed[test] = true
+	}
+
+	ft.evict(now)
+}
+
+func (ft *flakyTestMetrics) flipped(project azdo.Project, build azdo.Build, test string, now time.Time) {
+	labelValues := []string{project.Name, build.Definition.Name, test}
+	key := labelKey(labelValues)
+
+	flaky, ok := ft.flaky[key]
+	if !ok {
+		flaky = &flakyTest{LabelValues: labelValues}
+		ft.flaky[key] = flaky
+	}
+	flaky.Flips++
+	flaky.LastFlip = now
+}
+
+// evict forgets the commits and flaky tests that haven't been seen within the window
+func (ft *flakyTestMetrics) evict(now time.Time) {
+	for key, commit := range ft.commits {
+		if now.Sub(commit.lastSeen) > ft.window {
+			delete(ft.commits, key)
+		}
+	}
+	for key, flaky := range ft.flaky {
+		if now.Sub(flaky.LastFlip) > ft.window {
+			delete(ft.flaky, key)
+		}
+	}
+}
+
+// observeMarked counts the results of the test runs AzDO itself has marked as flaky
+func (ft *flakyTestMetrics) observeMarked(project azdo.Project, build azdo.Build, runs []azdo.TestRun) {
+	for _, run := range runs {
+		for _, statistic := range run.RunStatistics {
+			if statistic.ResultMetadata == "flaky" {
+				ft.markedFlaky.Add(float64(statistic.Count), project.Name, build.Definition.Name)
+			}
+		}
+	}
+}
+
+func (ft *flakyTestMetrics) Collect(ch chan<- prometheus.Metric) {
+	ft.markedFlaky.Collect(ch)
+
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	ft.evict(time.Now())
+
+	type definitionTests struct {
+		labelValues []string
+		count       int
+	}
+	perDefinition := make(map[string]*definitionTests)
+	tests := make([]*flakyTest, 0, len(ft.flaky))
+	for _, flaky := range ft.flaky {
+		key := labelKey(flaky.LabelValues[:2])
+		if _, ok := perDefinition[key]; !ok {
+			perDefinition[key] = &definitionTests{labelValues: flaky.LabelValues[:2]}
+		}
+		perDefinition[key].count++
+		tests = append(tests, flaky)
+	}
+
+	for _, definition := range perDefinition {
+		ch <- prometheus.MustNewConstMetric(flakyTestsDesc, prometheus.GaugeValue, float64(definition.count), definition.labelValues...)
+	}
+
+	// Only the flakiest tests are published, so the number of series stays bounded
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].Flips != tests[j].Flips {
+			return tests[i].Flips > tests[j].Flips
+		}
+		return tests[i].LastFlip.After(tests[j].LastFlip)
+	})
+	if len(tests) > ft.topN {
+		tests = tests[:ft.topN]
+	}
+	for _, flaky := range tests {
+		ch <- prometheus.MustNewConstMetric(flakyTestFlipsDesc, prometheus.GaugeValue, float64(flaky.Flips), flaky.LabelValues...)
+	}
+}
+
+// flakyTestResults retrieves the failed tests of the test runs of a finished build, and the passed tests
+// too when tests failed in the build or on an earlier build of the same commit
+func (azc *azDoCollector) flakyTestResults(ctx context.Context, project azdo.Project, build azdo.Build, runs []azdo.TestRun) (failed []string, passed []string, err error) {
+	// A test retried within the build, by the test runner or by re-running the failed jobs, fails in one
+	// run and passes in the same or another run of the build
+	failures := azc.flakyTests.hasFailures(project, build)
+	for _, run := range runs {
+		if testRunOutcomes(run)["failed"] > 0 {
+			failures = true
+		}
+	}
+
+	failed, passed = []string{}, []string{}
+	for _, run := range runs {
+		outcomes := testRunOutcomes(run)
+
+		if outcomes["failed"] > 0 {
+			results, err := azc.AzDoClient.GetTestResults(ctx, project.Name, run.Id, "Failed", "Aborted", "Error", "Timeout")
+			if err != nil {
+				azc.recordError(project.Name, err)
+				return nil, nil, err
+			}
+			failed = append(failed, testNames(results)...)
+		}
+
+		// Passed tests are only of interest to compare against failures
+		if failures && outcomes["passed"] > 0 {
+			results, err := azc.AzDoClient.GetTestResults(ctx, project.Name, run.Id, "Passed")
+			if err != nil {
+				azc.recordError(project.Name, err)
+				return nil, nil, err
+			}
+			passed = append(passed, testNames(results)...)
+		}
+	}
+	return failed, passed, nil
+}
+
+// testNames returns the name each test result is tracked under
+func testNames(results []azdo.TestResult) []string {
+	names := make([]string, 0, len(results))
+	for _, result := range results {
+		if result.AutomatedTestName != "" {
+			names = append(names, result.AutomatedTestName)
+		} else {
+			names = append(names, result.TestCaseTitle)
+		}
+	}
+	return names
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var flakyNow = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func flakyFlips(ft *flakyTestMetrics) map[string]int {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	flips := make(map[string]int)
+	for _, flaky := range ft.flaky {
+		flips[flaky.LabelValues[2]] = flaky.Flips
+	}
+	return flips
+}
+
+func TestFlakyTestMetricsObserve(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	commit := azdo.Build{Id: 1, Definition: azdo.Definition{Name: "ci"}, SourceBranch: "refs/heads/main", SourceVersion: "abc123"}
+	otherCommit := commit
+	otherCommit.Id, otherCommit.SourceVersion = 2, "def456"
+
+	type observation struct {
+		build  azdo.Build
+		failed []string
+		passed []string
+	}
+
+	tests := []struct {
+		name         string
+		observations []observation
+		want         map[string]int
+	}{
+		{
+			name:         "retried within the build",
+			observations: []observation{{build: commit, failed: []string{"TestA"}, passed: []string{"TestA", "TestB"}}},
+			want:         map[string]int{"TestA": 1},
+		},
+		{
+			name: "passes when the build is re-run",
+			observations: []observation{
+				{build: commit, failed: []string{"TestA"}},
+				{build: commit, passed: []string{"TestA", "TestB"}},
+			},
+			want: map[string]int{"TestA": 1},
+		},
+		{
+			name: "fails again after passing",
+			observations: []observation{
+				{build: commit, failed: []string{"TestA"}},
+				{build: commit, passed: []string{"TestA"}},
+				{build: commit, failed: []string{"TestA"}},
+			},
+			want: map[string]int{"TestA": 2},
+		},
+		{
+			name: "fails every time",
+			observations: []observation{
+				{build: commit, failed: []string{"TestA"}},
+				{build: commit, failed: []string{"TestA"}},
+			},
+			want: map[string]int{},
+		},
+		{
+			name: "passes on another commit",
+			observations: []observation{
+				{build: commit, failed: []string{"TestA"}},
+				{build: otherCommit, passed: []string{"TestA"}},
+			},
+			want: map[string]int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := newFlakyTestMetrics(time.Hour, 10)
+			for i, o := range tt.observations {
+				ft.Observe(project, o.build, o.failed, o.passed, flakyNow.Add(time.Duration(i)*time.Minute))
+			}
+
+			got := flakyFlips(ft)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got flips %v, want %v", got, tt.want)
+			}
+			for test, flips := range tt.want {
+				if got[test] != flips {
+					t.Errorf("got flips %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlakyTestMetricsEvict(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	build := azdo.Build{Id: 1, Definition: azdo.Definition{Name: "ci"}, SourceVersion: "abc123"}
+
+	ft := newFlakyTestMetrics(time.Hour, 10)
+	ft.Observe(project, build, []string{"TestA"}, []string{"TestA"}, flakyNow)
+
+	// Once it hasn't flipped within the window the flaky test is forgotten
+	ft.Observe(project, build, nil, []string{"TestA"}, flakyNow.Add(2*time.Hour))
+	if got := flakyFlips(ft); len(got) != 0 {
+		t.Errorf("got flips %v after the window, want none", got)
+	}
+}
+
+func TestFollowUpTestsRetriedWithinBuild(t *testing.T) {
+	// The first run of the build failed a test that passed when the failed job was re-run
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outcomes := r.URL.Query().Get("outcomes")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_apis/test/runs"):
+			fmt.Fprint(w, `{"count": 2, "value": [
+				{"id": 1, "totalTests": 2, "passedTests": 1, "unanalyzedTests": 1},
+				{"id": 2, "totalTests": 1, "passedTests": 1}
+			]}`)
+		case strings.Contains(r.URL.Path, "/runs/1/") && strings.Contains(outcomes, "Failed"):
+			fmt.Fprint(w, `{"count": 1, "value": [{"automatedTestName": "TestA", "outcome": "Failed"}]}`)
+		case strings.Contains(r.URL.Path, "/runs/1/"):
+			fmt.Fprint(w, `{"count": 1, "value": [{"automatedTestName": "TestB", "outcome": "Passed"}]}`)
+		case strings.Contains(r.URL.Path, "/runs/2/") && outcomes == "Passed":
+			fmt.Fprint(w, `{"count": 1, "value": [{"automatedTestName": "TestA", "outcome": "Passed"}]}`)
+		default:
+			t.Errorf("unexpected request for %v", r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	azc := newAzDoCollector(azDoConfig{
+		AzDoClient:      azdo.AzDoClient{Client: server.Client(), Name: "test", Address: server.URL},
+		FlakyTests:      true,
+		FlakyTestWindow: time.Hour,
+		FlakyTestTopN:   10,
+	}, nil, nil, time.Minute)
+
+	build := azdo.Build{Id: 1, Definition: azdo.Definition{Name: "ci"}, SourceVersion: "abc123"}
+	if err := azc.followUpTests(t.Context(), azdo.Project{Name: "project"}, build); err != nil {
+		t.Fatalf("followUpTests returned an error: %v", err)
+	}
+
+	if got := flakyFlips(azc.flakyTests); len(got) != 1 || got["TestA"] != 1 {
+		t.Errorf("got flips %v, want TestA to have flipped once", got)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var followUpsPendingDesc = prometheus.NewDesc(
+	"azdo_build_follow_ups_pending",
+	"Number of finished builds whose detail is still to be retrieved by the follow-up",
+	[]string{"project", "follow_up"},
+	nil,
+)
+
+// followUpQueue holds the finished builds each follow-up still has to retrieve the detail of. A build
+// is only taken off the queue once its follow-up succeeds, so detail that couldn't be retrieved by one
+// poll, because a request failed or the poll ran out of time, is retrieved by a later one. Builds are
+// dropped once they have been queued for longer than the ttl.
+type followUpQueue struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	pending map[string]pendingFollowUp // By followUpKey
+}
+
+// pendingFollowUp is a finished build still to be followed up
+type pendingFollowUp struct {
+	FollowUp string
+	Project  azdo.Project
+	Build    azdo.Build
+	QueuedAt time.Time
+}
+
+func newFollowUpQueue(ttl time.Duration) *followUpQueue {
+	return &followUpQueue{ttl: ttl, pending: make(map[string]pendingFollowUp)}
+}
+
+// followUpKey identifies the attempt of a build, a re-run keeps the id but finishes again
+func followUpKey(followUp string, project string, build azdo.Build) string {
+	return labelKey([]string{followUp, project, strconv.Itoa(build.Id), build.FinishTime.Format(time.RFC3339Nano)})
+}
+
+// add queues each of the builds for each of the follow-ups
+func (q *followUpQueue) add(followUps []string, project azdo.Project, builds []azdo.Build, now time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, build := range builds {
+		for _, followUp := range followUps {
+			key := followUpKey(followUp, project.Name, build)
+			if _, ok := q.pending[key]; !ok {
+				q.pending[key] = pendingFollowUp{FollowUp: followUp, Project: project, Build: build, QueuedAt: now}
+			}
+		}
+	}
+}
+
+// due returns the follow-ups queued for the project, oldest first. They stay queued until they are done.
+func (q *followUpQueue) due(project string) []pendingFollowUp {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	due := []pendingFollowUp{}
+	for _, pending := range q.pending {
+		if pending.Project.Name == project {
+			due = append(due, pending)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].QueuedAt.Equal(due[j].QueuedAt) {
+			return due[i].QueuedAt.Before(due[j].QueuedAt)
+		}
+		return due[i].Build.FinishTime.Before(due[j].Build.FinishTime)
+	})
+	return due
+}
+
+// done takes the follow-up off the queue
+func (q *followUpQueue) done(pending pendingFollowUp) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.pending, followUpKey(pending.FollowUp, pending.Project.Name, pending.Build))
+}
+
+// evict drops the follow-ups queued for longer than the ttl, returning them
+func (q *followUpQueue) evict(now time.Time) []pendingFollowUp {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	dropped := []pendingFollowUp{}
+	for key, pending := range q.pending {
+		if now.Sub(pending.QueuedAt) > q.ttl {
+			dropped = append(dropped, pending)
+			delete(q.pending, key)
+		}
+	}
+	return dropped
+}
+
+// snapshot returns a copy of every follow-up queued
+func (q *followUpQueue) snapshot() []pendingFollowUp {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pending := make([]pendingFollowUp, 0, len(q.pending))
+	for _, p := range q.pending {
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// restore queues the follow-ups saved by snapshot
+func (q *followUpQueue) restore(pending []pendingFollowUp) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, p := range pending {
+		q.pending[followUpKey(p.FollowUp, p.Project.Name, p.Build)] = p
+	}
+}
+
+func (q *followUpQueue) Collect(ch chan<- prometheus.Metric) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	labels := make(map[string][]string)
+	sizes := make(map[string]int)
+	for _, pending := range q.pending {
+		labelValues := []string{pending.Project.Name, pending.FollowUp}
+		key := labelKey(labelValues)
+		labels[key] = labelValues
+		sizes[key]++
+	}
+
+	for key, labelValues := range labels {
+		ch <- prometheus.MustNewConstMetric(followUpsPendingDesc, prometheus.GaugeValue, float64(sizes[key]), labelValues...)
+	}
+}
+
+// followUpNames returns the names of the follow-ups of the collector, in order
+func (azc *azDoCollector) followUpNames() []string {
+	names := make([]string, 0, len(azc.followUps))
+	for name := range azc.followUps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runFollowUp retrieves the detail of a queued build, taking it off the queue once it has been retrieved.
+// A build whose detail no longer exists, or whose follow-up has since been turned off, is given up on.
+func (azc *azDoCollector) runFollowUp(ctx context.Context, pending pendingFollowUp) {
+	followUp, ok := azc.followUps[pending.FollowUp]
+	if !ok {
+		azc.followUpQueue.done(pending)
+		return
+	}
+
+	// Left for the next poll rather than failing every request once the poll has run out of time
+	if ctx.Err() != nil {
+		return
+	}
+
+	err := followUp(ctx, pending.Project, pending.Build)
+	if err == nil || azdo.ErrorKindOf(err) == azdo.ErrorKindNotFound {
+		azc.followUpQueue.done(pending)
+	}
+}
+
+// evictFollowUps drops the builds that couldn't be followed up within the ttl, counting them
+func (azc *azDoCollector) evictFollowUps(now time.Time) {
+	for _, pending := range azc.followUpQueue.evict(now) {
+		log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "project": pending.Project.Name, "followUp": pending.FollowUp, "build": pending.Build.Id}).Warning("Gave up following up build")
+		azc.followUpsDropped.WithLabelValues(pending.Project.Name, pending.FollowUp).Inc()
+	}
+}
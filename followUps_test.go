@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestFollowUpQueue(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	first := finishedBuild(1, time.Minute, "succeeded")
+	second := finishedBuild(2, 2*time.Minute, "failed")
+	rerun := finishedBuild(1, 5*time.Minute, "succeeded")
+
+	q := newFollowUpQueue(time.Hour)
+	q.add([]string{"tests", "timeline"}, project, []azdo.Build{second, first}, ledgerStart)
+	q.add([]string{"tests"}, project, []azdo.Build{rerun}, ledgerStart.Add(10*time.Minute))
+
+	// Queuing a build again doesn't queue it twice or make it any younger
+	q.add([]string{"tests"}, project, []azdo.Build{first}, ledgerStart.Add(20*time.Minute))
+
+	due := q.due("project")
+	if len(due) != 5 {
+		t.Fatalf("got %d follow-ups due, want 5", len(due))
+	}
+	if due[0].Build.Id != 1 || due[len(due)-1].Build.FinishTime != rerun.FinishTime {
+		t.Errorf("follow-ups aren't due oldest first: %v", due)
+	}
+	if got := q.due("other"); len(got) != 0 {
+		t.Errorf("got %d follow-ups due for another project, want 0", len(got))
+	}
+
+	q.done(pendingFollowUp{FollowUp: "tests", Project: project, Build: first})
+	if got := len(q.due("project")); got != 4 {
+		t.Errorf("got %d follow-ups due once one is done, want 4", got)
+	}
+
+	// Only the builds queued for longer than the ttl are dropped
+	dropped := q.evict(ledgerStart.Add(65 * time.Minute))
+	if len(dropped) != 3 {
+		t.Errorf("dropped %d follow-ups, want 3", len(dropped))
+	}
+	if due := q.due("project"); len(due) != 1 || due[0].Build.FinishTime != rerun.FinishTime {
+		t.Errorf("got %v due after eviction, want the re-run", due)
+	}
+}
+
+func TestRunFollowUp(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	build := finishedBuild(1, time.Minute, "failed")
+
+	attempts := map[string]int{}
+	azc := newAzDoCollector(azDoConfig{LedgerTTL: time.Hour}, nil, nil, time.Minute)
+	azc.followUps = map[string]buildFollowUp{
+		"succeeds": func(ctx context.Context, project azdo.Project, build azdo.Build) error {
+			attempts["succeeds"]++
+			return nil
+		},
+		"fails once": func(ctx context.Context, project azdo.Project, build azdo.Build) error {
+			attempts["fails once"]++
+			if attempts["fails once"] == 1 {
+				return &azdo.RequestError{Kind: azdo.ErrorKindTimeout, Err: errors.New("deadline exceeded")}
+			}
+			return nil
+		},
+		"gone": func(ctx context.Context, project azdo.Project, build azdo.Build) error {
+			attempts["gone"]++
+			return &azdo.RequestError{Kind: azdo.ErrorKindNotFound, Err: errors.New("not found")}
+		},
+	}
+	azc.followUpQueue.add(append(azc.followUpNames(), "turned off"), project, []azdo.Build{build}, ledgerStart)
+
+	poll := func(ctx context.Context) []string {
+		for _, pending := range azc.followUpQueue.due("project") {
+			azc.runFollowUp(ctx, pending)
+		}
+		pending := []string{}
+		for _, p := range azc.followUpQueue.due("project") {
+			pending = append(pending, p.FollowUp)
+		}
+		return pending
+	}
+
+	// A poll that has run out of time leaves everything for the next
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if pending := poll(ctx); len(pending) != 3 {
+		t.Errorf("got %v pending after a poll out of time, want the 3 follow-ups still configured", pending)
+	}
+
+	if pending := poll(t.Context()); len(pending) != 1 || pending[0] != "fails once" {
+		t.Errorf("got %v pending after the first poll, want [fails once]", pending)
+	}
+	if pending := poll(t.Context()); len(pending) != 0 {
+		t.Errorf("got %v pending after the second poll, want none", pending)
+	}
+
+	want := map[string]int{"succeeds": 1, "fails once": 2, "gone": 1}
+	for name, count := range want {
+		if attempts[name] != count {
+			t.Errorf("follow-up %q was attempted %d times, want %d", name, attempts[name], count)
+		}
+	}
+}
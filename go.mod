@@ -8,6 +8,8 @@ require (
 	github.com/mattn/go-colorable v0.1.14
 	github.com/prometheus/client_golang v1.21.1
 	github.com/sirupsen/logrus v1.9.3
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/time v0.11.0
 )
 
 require (
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+// seenLedger remembers, per scope (e.g. project), the finished items already accounted for so each
+// is only counted once, even when it is returned again by overlapping incremental queries.
+type seenLedger struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]map[int]ledgerEntry
+	polled  map[string]bool // Scopes that have been polled since the exporter started
+}
+
+type ledgerEntry struct {
+	FinishTime time.Time
+	Result     string
+	LastSeen   time.Time
+}
+
+func newSeenLedger(ttl time.Duration) *seenLedger {
+	return &seenLedger{ttl: ttl, entries: make(map[string]map[int]ledgerEntry), polled: make(map[string]bool)}
+}
+
+// firstPoll reports if the scope is being polled for the first time, with nothing restored for it
+// from the saved state, marking it as polled. The items returned by the first poll of a scope are
+// admitted to seed the ledger but not counted, as they finished before the exporter started.
+func (l *seenLedger) firstPoll(scope string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.polled[scope] {
+		return false
+	}
+	l.polled[scope] = true
+
+	_, restored := l.entries[scope]
+	return !restored
+}
+
+// admit returns the finished builds that haven't been accounted for yet and records them.
+// A build that is re-run keeps its id but finishes again with a new finish time and result,
+// so it is admitted again as a new attempt.
+func (l *seenLedger) admit(project string, builds []azdo.Build, now time.Time) []azdo.Build {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	seen, ok := l.entries[project]
+	if !ok {
+		seen = make(map[int]ledgerEntry)
+		l.entries[project] = seen
+	}
+
+	admitted := []azdo.Build{}
+	for _, build := range builds {
+		entry, ok := seen[build.Id]
+		if !ok || !entry.FinishTime.Equal(build.FinishTime) {
+			admitted = append(admitted, build)
+		}
+		seen[build.Id] = ledgerEntry{FinishTime: build.FinishTime, Result: build.Result, LastSeen: now}
+	}
+	return admitted
+}
+
+// admitOnce reports if the item hasn't been accounted for yet under the scope, recording it if so.
+// An item that finishes again with a different finish time is admitted again.
+func (l *seenLedger) admitOnce(scope string, id int, finishTime time.Time, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	seen, ok := l.entries[scope]
+	if !ok {
+		seen = make(map[int]ledgerEntry)
+		l.entries[scope] = seen
+	}
+
+	entry, ok := seen[id]
+	seen[id] = ledgerEntry{FinishTime: finishTime, LastSeen: now}
+	return !ok || !entry.FinishTime.Equal(finishTime)
+}
+
+// evict forgets the items that haven't been returned for longer than the ttl
+func (l *seenLedger) evict(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for project, seen := range l.entries {
+		for id, entry := range seen {
+			if now.Sub(entry.LastSeen) > l.ttl {
+				delete(seen, id)
+			}
+		}
+		if len(seen) == 0 {
+			delete(l.entries, project)
+		}
+	}
+}
+
+// snapshot returns a copy of every item held
+func (l *seenLedger) snapshot() map[string]map[int]ledgerEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entries := make(map[string]map[int]ledgerEntry, len(l.entries))
+	for project, seen := range l.entries {
+		entries[project] = make(map[int]ledgerEntry, len(seen))
+		for id, entry := range seen {
+			entries[project][id] = entry
+		}
+	}
+	return entries
+}
+
+// restore adds items saved by snapshot to the ledger
+func (l *seenLedger) restore(entries map[string]map[int]ledgerEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for project, saved := range entries {
+		seen, ok := l.entries[project]
+		if !ok {
+			seen = make(map[int]ledgerEntry, len(saved))
+			l.entries[project] = seen
+		}
+		for id, entry := range saved {
+			seen[id] = entry
+		}
+	}
+}
+
+// size returns the number of items held for each scope
+func (l *seenLedger) size() map[string]int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	sizes := make(map[string]int, len(l.entries))
+	for project, seen := range l.entries {
+		sizes[project] = len(seen)
+	}
+	return sizes
+}
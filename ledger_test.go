@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var ledgerStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func finishedBuild(id int, finished time.Duration, result string) azdo.Build {
+	return azdo.Build{Id: id, FinishTime: ledgerStart.Add(finished), Result: result}
+}
+
+func buildIds(builds []azdo.Build) []int {
+	ids := []int{}
+	for _, build := range builds {
+		ids = append(ids, build.Id)
+	}
+	return ids
+}
+
+func equalIds(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSeenLedgerAdmit(t *testing.T) {
+	tests := []struct {
+		name   string
+		seen   []azdo.Build // Admitted before the builds
+		builds []azdo.Build
+		want   []int
+	}{
+		{
+			name:   "new builds are admitted",
+			builds: []azdo.Build{finishedBuild(1, time.Minute, "succeeded"), finishedBuild(2, 2*time.Minute, "failed")},
+			want:   []int{1, 2},
+		},
+		{
+			name:   "builds already seen are dropped",
+			seen:   []azdo.Build{finishedBuild(1, time.Minute, "succeeded")},
+			builds: []azdo.Build{finishedBuild(1, time.Minute, "succeeded"), finishedBuild(2, 2*time.Minute, "failed")},
+			want:   []int{2},
+		},
+		{
+			name:   "re-run with a new finish time is admitted again",
+			seen:   []azdo.Build{finishedBuild(1, time.Minute, "failed")},
+			builds: []azdo.Build{finishedBuild(1, 5*time.Minute, "succeeded")},
+			want:   []int{1},
+		},
+		{
+			name:   "same build twice in one poll is admitted once",
+			builds: []azdo.Build{finishedBuild(1, time.Minute, "canceled"), finishedBuild(1, time.Minute, "canceled")},
+			want:   []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newSeenLedger(time.Hour)
+			ledger.admit("project", tt.seen, ledgerStart)
+
+			got := buildIds(ledger.admit("project", tt.builds, ledgerStart.Add(time.Minute)))
+			if !equalIds(got, tt.want) {
+				t.Errorf("admitted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeenLedgerAdmitScopes(t *testing.T) {
+	ledger := newSeenLedger(time.Hour)
+	ledger.admit("first", []azdo.Build{finishedBuild(1, time.Minute, "succeeded")}, ledgerStart)
+
+	// Ids are only unique within a project
+	got := buildIds(ledger.admit("second", []azdo.Build{finishedBuild(1, time.Minute, "succeeded")}, ledgerStart))
+	if !equalIds(got, []int{1}) {
+		t.Errorf("admitted %v in the second project, want [1]", got)
+	}
+}
+
+func TestSeenLedgerAdmitOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		seen       bool // Whether the item was admitted before, finishing at seenFinish
+		seenFinish time.Time
+		finish     time.Time
+		want       bool
+	}{
+		{name: "new item", finish: ledgerStart, want: true},
+		{name: "item already seen", seen: true, seenFinish: ledgerStart, finish: ledgerStart, want: false},
+		{name: "item finished again", seen: true, seenFinish: ledgerStart, finish: ledgerStart.Add(time.Minute), want: true},
+		{name: "item without a finish time already seen", seen: true, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newSeenLedger(time.Hour)
+			if tt.seen {
+				ledger.admitOnce("scope", 7, tt.seenFinish, ledgerStart)
+			}
+
+			if got := ledger.admitOnce("scope", 7, tt.finish, ledgerStart.Add(time.Minute)); got != tt.want {
+				t.Errorf("admitOnce returned %v, want %v", got, tt.want)
+			}
+			if got := ledger.admitOnce("scope", 7, tt.finish, ledgerStart.Add(2*time.Minute)); got {
+				t.Error("admitOnce admitted the item a second time")
+			}
+		})
+	}
+}
+
+func TestSeenLedgerEvict(t *testing.T) {
+	ttl := time.Hour
+
+	tests := []struct {
+		name      string
+		lastSeen  time.Duration // Since ledgerStart
+		evictAt   time.Duration
+		wantKept  bool
+		wantScope bool // Whether the scope is still held
+	}{
+		{name: "seen within the ttl", lastSeen: 0, evictAt: 30 * time.Minute, wantKept: true, wantScope: true},
+		{name: "seen exactly the ttl ago", lastSeen: 0, evictAt: ttl, wantKept: true, wantScope: true},
+		{name: "seen longer than the ttl ago", lastSeen: 0, evictAt: ttl + time.Second, wantKept: false, wantScope: false},
+		{name: "returned again since", lastSeen: 50 * time.Minute, evictAt: ttl + time.Second, wantKept: true, wantScope: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger := newSeenLedger(ttl)
+			build := finishedBuild(1, 0, "succeeded")
+			ledger.admit("project", []azdo.Build{build}, ledgerStart)
+			ledger.admit("project", []azdo.Build{build}, ledgerStart.Add(tt.lastSeen))
+
+			ledger.evict(ledgerStart.Add(tt.evictAt))
+
+			if _, ok := ledger.size()["project"]; ok != tt.wantScope {
+				t.Errorf("scope held is %v, want %v", ok, tt.wantScope)
+			}
+
+			// A build still remembered isn't admitted again, a forgotten one is
+			admitted := len(ledger.admit("project", []azdo.Build{build}, ledgerStart.Add(tt.evictAt))) == 1
+			if admitted == tt.wantKept {
+				t.Errorf("build admitted again is %v, want %v", admitted, !tt.wantKept)
+			}
+		})
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -15,6 +19,14 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+// Set at build time with -ldflags "-X main.version=<version> -X main.commit=<commit>"
+var (
+	version = "dev"
+	commit  = "unknown"
 )
 
 // Validate the connection
@@ -47,7 +59,7 @@ func main() {
 		"path": *pathToConfig,
 	})
 
-	configLogger.Info("start")
+	configLogger.WithFields(log.Fields{"version": version, "commit": commit}).Info("start")
 
 	// Read config
 	var c config
@@ -85,6 +97,55 @@ func main() {
 			configValid = false
 		}
 
+		if server.RequestTimeout == 0 {
+			server.RequestTimeout = requestTimeoutDefault
+			c.Servers[name] = server
+		}
+
+		if server.ScrapeTimeout == 0 {
+			server.ScrapeTimeout = scrapeTimeoutDefault
+			c.Servers[name] = server
+		}
+		if server.PollInterval == 0 {
+			server.PollInterval = pollIntervalDefault
+			c.Servers[name] = server
+		}
+		configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "requestTimeout": server.RequestTimeout, "scrapeTimeout": server.ScrapeTimeout, "pollInterval": server.PollInterval}).Debug("Timeouts for server")
+
+		if server.Concurrency <= 0 {
+			server.Concurrency = concurrencyDefault
+			c.Servers[name] = server
+		}
+
+		if server.WatermarkOverlap == 0 {
+			server.WatermarkOverlap = watermarkOverlapDefault
+			c.Servers[name] = server
+		}
+
+		if server.AgentFailureWindow == 0 {
+			server.AgentFailureWindow = agentFailureWindowDefault
+			c.Servers[name] = server
+		}
+
+		if server.FlakyTestWindow == 0 {
+			server.FlakyTestWindow = flakyTestWindowDefault
+			c.Servers[name] = server
+		}
+		if server.FlakyTestTopN <= 0 {
+			server.FlakyTestTopN = flakyTestTopNDefault
+			c.Servers[name] = server
+		}
+
+		// The ledger has to remember builds for longer than they can be returned again
+		if server.LedgerTTL == 0 {
+			server.LedgerTTL = ledgerTTLDefault
+			c.Servers[name] = server
+		}
+		if server.LedgerTTL <= server.WatermarkOverlap {
+			configLogger.WithFields(log.Fields{"serverName": fmt.Sprintf("servers.%v", name), "ledgerTTL": server.LedgerTTL, "watermarkOverlap": server.WatermarkOverlap}).Error("ledgerTTL must be longer than watermarkOverlap")
+			configValid = false
+		}
+
 		// Check that if a server has proxy set to true that the proxy table has been populated
 		if server.UseProxy && c.Proxy.URL == "" {
 			configLogger.WithField("serverName", fmt.Sprintf("servers.%v", name)).Error("UseProxy is true for but proxy url has not been set.")
@@ -118,33 +179,85 @@ func main() {
 		configLogger.WithField("endpoint", c.Exporter.Endpoint).Debug("Metrics will be exposed on endpoint specified")
 	}
 
+	if c.State.SaveInterval == 0 {
+		c.State.SaveInterval = saveIntervalDefault
+	}
+
 	if configValid == false {
 		configLogger.Fatal("Errors found within config")
 		return
 	}
 
+	// Open the state store, so restarts carry on from where the last run stopped
+	var store *stateStore
+	if c.State.Path != "" {
+		store, err = openStateStore(c.State.Path)
+		if err != nil {
+			log.WithFields(log.Fields{"path": c.State.Path, "error": err}).Fatal("Failed to open state store")
+			return
+		}
+		defer store.close()
+		log.WithFields(log.Fields{"path": c.State.Path, "saveInterval": c.State.SaveInterval}).Info("State will be saved")
+	}
+
+	// Shared by the worker pools of every server
+	global := newGlobalSlots(c.Exporter.Concurrency)
+	globalInFlight := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "azdo_worker_pool_global_in_flight_tasks",
+		Help: "Number of tasks being run across the worker pools of every server",
+	}, func() float64 { return float64(len(global)) })
+
 	// Create and configure azdoCollector
 	var azDoCollectors []*azDoCollector
 	for name, server := range c.Servers {
 		server.Name = name
 		if server.UseProxy {
 			log.WithFields(log.Fields{"server": server.Name, "serverAddress": server.Address}).Info("Proxy will be used")
-			server.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), IdleConnTimeout: time.Second * 20}}
+			server.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), IdleConnTimeout: time.Second * 20}, Timeout: server.RequestTimeout}
 		} else {
-			server.Client = &http.Client{Transport: &http.Transport{IdleConnTimeout: time.Second * 20}}
+			server.Client = &http.Client{Transport: &http.Transport{IdleConnTimeout: time.Second * 20}, Timeout: server.RequestTimeout}
 		}
+		server.Throttle = azdo.NewThrottle(server.RequestsPerSecond)
+
+		collector := newAzDoCollector(server, global, store, c.State.SaveInterval)
+		collector.loadState()
 
-		azDoCollectors = append(azDoCollectors, newAzDoCollector(server.AzDoClient))
+		azDoCollectors = append(azDoCollectors, collector)
 		log.WithFields(log.Fields{"server": server.Name, "serverAddress": server.Address}).Info("Metrics collector created")
 	}
 
 	// Add each azdoCollector to the register so they get called when Prometheus scrapes.
+	// The builds are polled in the background, a scrape only serves the last snapshot.
+	// Pollers stop, saving their state, when the exporter is asked to shut down.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var pollers sync.WaitGroup
 	var reg = prometheus.NewRegistry()
+	reg.MustRegister(azdo.Collectors()...)
+	reg.MustRegister(newBuildInfo())
+	reg.MustRegister(globalInFlight)
 	for _, tc := range azDoCollectors {
 		prometheus.WrapRegistererWith(prometheus.Labels{"name": tc.AzDoClient.Name}, reg).MustRegister(tc)
+
+		pollers.Add(1)
+		go func(tc *azDoCollector) {
+			defer pollers.Done()
+			tc.run(ctx)
+		}(tc)
 	}
 
-	http.Handle(c.Exporter.Endpoint, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	// A server failing to be polled is logged and shouldn't stop the metrics of the other servers being served
+	http.Handle(c.Exporter.Endpoint, promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		ErrorLog:      log.StandardLogger(),
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
 	log.Info("Serving metrics at " + c.Exporter.Endpoint + " on port: " + strconv.Itoa(c.Exporter.Port))
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(c.Exporter.Port), nil))
+	go func() {
+		log.Fatal(http.ListenAndServe(":"+strconv.Itoa(c.Exporter.Port), nil))
+	}()
+
+	<-ctx.Done()
+	log.Info("Shutting down")
+	pollers.Wait()
 }
@@ -2,18 +2,49 @@ package main
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+	"runtime"
 	"strconv"
 	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
 )
 
 var (
 	totalcollectDurationDesc = prometheus.NewDesc(
 		"azdo_build_build_total_scrape_duration_seconds",
-		"Duration of time it took to scrape total of builds",
+		"Duration of time it took to poll AzDO for the builds",
+		[]string{},
+		nil,
+	)
+
+	upDesc = prometheus.NewDesc(
+		"azdo_up",
+		"Whether the last poll of AzDO succeeded in listing the projects",
+		[]string{},
+		nil,
+	)
+
+	projectScrapeSuccessDesc = prometheus.NewDesc(
+		"azdo_project_scrape_success",
+		"Whether the builds of the project were retrieved by the last poll",
+		[]string{"project"},
+		nil,
+	)
+
+	snapshotAgeDesc = prometheus.NewDesc(
+		"azdo_snapshot_age_seconds",
+		"Time since the metrics served were retrieved from AzDO",
 		[]string{},
 		nil,
 	)
 
+	ledgerSizeDesc = prometheus.NewDesc(
+		"azdo_build_ledger_size",
+		"Number of finished builds remembered to stop them being counted twice",
+		[]string{"project"},
+		nil,
+	)
+
 	buildTimeToCompleteDesc = prometheus.NewDesc(
 		"azdo_build_complete_in_seconds",
 		"Build complete in seconds",
@@ -77,8 +108,50 @@ var (
 		nil,
 	)
 
+	rateLimitLimitDesc = prometheus.NewDesc(
+		"azdo_ratelimit_limit",
+		"TSTUs allowed by AzDO within the sliding window, as last reported by X-RateLimit-Limit",
+		[]string{},
+		nil,
+	)
+
+	rateLimitRemainingDesc = prometheus.NewDesc(
+		"azdo_ratelimit_remaining",
+		"TSTUs remaining before AzDO blocks requests, as last reported by X-RateLimit-Remaining",
+		[]string{},
+		nil,
+	)
+
+	rateLimitDelayDesc = prometheus.NewDesc(
+		"azdo_ratelimit_delay_seconds",
+		"Delay AzDO applied to the last request, as reported by X-RateLimit-Delay",
+		[]string{},
+		nil,
+	)
+
+	rateLimitBlockedDesc = prometheus.NewDesc(
+		"azdo_ratelimit_blocked_seconds",
+		"Time left before the exporter sends requests to AzDO again, from Retry-After and X-RateLimit-Delay",
+		[]string{},
+		nil,
+	)
+
 )
 
+// newBuildInfo returns a gauge, always 1, labelled with the version of the exporter
+func newBuildInfo() prometheus.Gauge {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "azdo_exporter_build_info",
+		Help:        "Version of the exporter, always 1",
+		ConstLabels: prometheus.Labels{"version": version, "commit": commit, "goversion": runtime.Version()},
+	})
+	buildInfo.Set(1)
+	return buildInfo
+}
+
+// Every result AzDO can give a finished build
+var buildResults = []string{"succeeded", "partiallySucceeded", "failed", "canceled", "none"}
+
 func calculateBuckets() []float64 {
 	var b = buckets(0, 15, 8)                       // start at 0, gap of 15 between buckets and 10 of them
 	b = append(b, buckets(b[len(b)-1], 30, 10)...)  // start of the last value of previous slice, gap of 30 between buckets and 10 of them
@@ -155,57 +228,83 @@ func calculateBuildMetrics(mc metricsContext) []prometheus.Metric {
 		}
 	}
 
-	promMetrics = append(promMetrics, calculateHistograms(mc)...)
 	promMetrics = append(promMetrics, calculateQueueMetrics(mc)...)
 	promMetrics = append(promMetrics, calculateBuildResultMetrics(mc)...)
 
 	return promMetrics
 }
 
-func calculateHistograms(metricContext metricsContext) []prometheus.Metric {
+// newBuildResultsTotalDesc describes the build results counter, along with the optional labels that are turned on
+func newBuildResultsTotalDesc(extraLabels buildLabels) *prometheus.Desc {
+	return prometheus.NewDesc(
+		"azdo_build_results_total",
+		"Total of finished builds by result, accumulated since the exporter started",
+		append([]string{"project", "definition", "result"}, extraLabels.names()...),
+		nil,
+	)
+}
 
-	totalTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "azdo_build_total_length_secs",
-		Help:        "Total length of azdo_build duration for pool",
-		Buckets:     calculateBuckets(),
-		ConstLabels: map[string]string{"Project": metricContext.Project.Name},
-	})
+// buildDurationHistograms accumulate the durations of finished builds across polls,
+// per project and optionally per definition, reason and branch
+type buildDurationHistograms struct {
+	byDefinition bool
+	extraLabels  buildLabels
+	totalTimes   *histogramSet
+	queueTimes   *histogramSet
+	jobTimes     *histogramSet
+}
 
-	for _, job := range metricContext.Builds {
-		totalTime := job.FinishTime.Sub(job.QueueTime)
-		totalTimes.Observe(totalTime.Seconds())
+func newBuildDurationHistograms(byDefinition bool, extraLabels buildLabels) *buildDurationHistograms {
+	labels := []string{"project"}
+	if byDefinition {
+		labels = append(labels, "definition")
 	}
+	labels = append(labels, extraLabels.names()...)
+
+	return &buildDurationHistograms{
+		byDefinition: byDefinition,
+		extraLabels:  extraLabels,
+		totalTimes: newHistogramSet(
+			prometheus.NewDesc("azdo_build_total_length_secs", "Total length of azdo_build duration, from queued to finished", labels, nil),
+			calculateBuckets(),
+		),
+		queueTimes: newHistogramSet(
+			prometheus.NewDesc("azdo_build_queue_length_secs", "Total length of queue duration for build", labels, nil),
+			prometheus.ExponentialBuckets(1, 2, 10), // 10 buckets, starting at one, doubling
+		),
+		jobTimes: newHistogramSet(
+			prometheus.NewDesc("azdo_build_running_length_secs", "Total length of running duration for build", labels, nil),
+			calculateBuckets(),
+		),
+	}
+}
 
-	queueTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "azdo_build_queue_length_secs",
-		Help:        "Total length of queue duration for build",
-		Buckets:     prometheus.ExponentialBuckets(1, 2, 10), // 10 buckets, starting at one, doubling
-		ConstLabels: map[string]string{"project": metricContext.Project.Name},
-	})
-
+// Observe adds the durations of the finished builds of the metricsContext to the histograms
+func (h *buildDurationHistograms) Observe(metricContext metricsContext) {
 	for _, job := range metricContext.Builds {
-		queueTime := job.StartTime.Sub(job.QueueTime) // Time received by the agent - Time queued by the user
-		queueTimes.Observe(queueTime.Seconds())
-	}
+		labelValues := []string{metricContext.Project.Name}
+		if h.byDefinition {
+			labelValues = append(labelValues, job.Definition.Name)
+		}
+		labelValues = append(labelValues, h.extraLabels.values(job)...)
 
-	jobTimes := prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:        "azdo_build_running_length_secs",
-		Help:        "Total length of queue duration for pool",
-		Buckets:     calculateBuckets(),
-		ConstLabels: map[string]string{"project": metricContext.Project.Name},
-	})
+		h.totalTimes.Observe(job.FinishTime.Sub(job.QueueTime).Seconds(), labelValues...)
 
-	for _, job := range metricContext.Builds {
-		jobTime := job.FinishTime.Sub(job.StartTime)
-		jobTimes.Observe(jobTime.Seconds())
-	}
-	return []prometheus.Metric{
-		totalTimes,
-		queueTimes,
-		jobTimes,
+		// Builds cancelled before an agent picked them up never started, so were neither queued nor running for a known time
+		if job.StartTime.IsZero() {
+			continue
+		}
+		h.queueTimes.Observe(job.StartTime.Sub(job.QueueTime).Seconds(), labelValues...) // Time received by the agent - Time queued by the user
+		h.jobTimes.Observe(job.FinishTime.Sub(job.StartTime).Seconds(), labelValues...)
 	}
 }
 
+func (h *buildDurationHistograms) Collect(ch chan<- prometheus.Metric) {
+	h.totalTimes.Collect(ch)
+	h.queueTimes.Collect(ch)
+	h.jobTimes.Collect(ch)
+}
+
 func calculateQueueMetrics(metricContext metricsContext) []prometheus.Metric {
 
 	queuedTotal := 0
@@ -315,3 +414,29 @@ func calculateBuildResultMetrics(metricContext metricsContext) []prometheus.Metr
 	return promMetrics
 }
 
+func calculateThrottleMetrics(state azdo.ThrottleState) []prometheus.Metric {
+	return []prometheus.Metric{
+		prometheus.MustNewConstMetric(rateLimitLimitDesc, prometheus.GaugeValue, state.Limit),
+		prometheus.MustNewConstMetric(rateLimitRemainingDesc, prometheus.GaugeValue, state.Remaining),
+		prometheus.MustNewConstMetric(rateLimitDelayDesc, prometheus.GaugeValue, state.Delay.Seconds()),
+		prometheus.MustNewConstMetric(rateLimitBlockedDesc, prometheus.GaugeValue, state.BlockedFor.Seconds()),
+	}
+}
+
+// accumulateBuildResults counts the result of each finished build into the cumulative results counters
+func accumulateBuildResults(mc metricsContext, results *counterSet, extraLabels buildLabels) {
+	for _, build := range mc.Builds {
+		extraValues := extraLabels.values(build)
+
+		// Create every result of the definition at zero, so the first build with a result is seen by rate()
+		for _, result := range buildResults {
+			results.Add(0, append([]string{mc.Project.Name, build.Definition.Name, result}, extraValues...)...)
+		}
+
+		result := build.Result
+		if result == "" {
+			result = "none"
+		}
+		results.Add(1, append([]string{mc.Project.Name, build.Definition.Name, result}, extraValues...)...)
+	}
+}
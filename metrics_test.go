@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestBuildDurationHistogramsObserve(t *testing.T) {
+	queued := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		build       azdo.Build
+		wantTotal   float64
+		wantQueue   []float64 // Sum of the observations, nil if there shouldn't be any
+		wantRunning []float64
+	}{
+		{
+			name:        "started",
+			build:       azdo.Build{Id: 1, QueueTime: queued, StartTime: queued.Add(30 * time.Second), FinishTime: queued.Add(5 * time.Minute)},
+			wantTotal:   300,
+			wantQueue:   []float64{30},
+			wantRunning: []float64{270},
+		},
+		{
+			name:      "cancelled before it started",
+			build:     azdo.Build{Id: 2, QueueTime: queued, FinishTime: queued.Add(2 * time.Minute), Result: "canceled"},
+			wantTotal: 120,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newBuildDurationHistograms(false, buildLabels{})
+			h.Observe(metricsContext{Project: azdo.Project{Name: "project"}, Builds: []azdo.Build{tt.build}})
+
+			assertHistogramSums(t, "total", h.totalTimes, []float64{tt.wantTotal})
+			assertHistogramSums(t, "queue", h.queueTimes, tt.wantQueue)
+			assertHistogramSums(t, "running", h.jobTimes, tt.wantRunning)
+		})
+	}
+}
+
+// assertHistogramSums checks the histograms of the set have one observation each, with the sums wanted
+func assertHistogramSums(t *testing.T, name string, h *histogramSet, want []float64) {
+	t.Helper()
+
+	values := h.snapshot()
+	if len(values) != len(want) {
+		t.Fatalf("%s has %d histograms, want %d", name, len(values), len(want))
+	}
+	for i, value := range values {
+		if value.Count != 1 || value.Sum != want[i] {
+			t.Errorf("%s histogram has count %d and sum %v, want count 1 and sum %v", name, value.Count, value.Sum, want[i])
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	releaseDeploymentsDesc = prometheus.NewDesc(
+		"azdo_release_deployments_total",
+		"Total of finished deployments of classic releases to the environment by result",
+		[]string{"project", "definition", "environment", "result"},
+		nil,
+	)
+
+	releaseDeploymentDurationDesc = prometheus.NewDesc(
+		"azdo_release_deployment_duration_seconds",
+		"Duration of finished deployments of classic releases to the environment",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+
+	releaseApprovalWaitDesc = prometheus.NewDesc(
+		"azdo_release_approval_wait_seconds",
+		"Time approvals of deployments of classic releases waited to be approved or rejected",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+
+	releasePendingApprovalsDesc = prometheus.NewDesc(
+		"azdo_release_pending_approvals",
+		"Number of deployments of classic releases waiting for approval",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+
+	releaseOldestPendingApprovalDesc = prometheus.NewDesc(
+		"azdo_release_oldest_pending_approval_age_seconds",
+		"Time the oldest approval of a deployment of a classic release has been waiting",
+		[]string{"project", "definition", "environment"},
+		nil,
+	)
+)
+
+// Number of the most recent deployments of classic releases retrieved for each project on every poll
+const releaseDeploymentCount = 200
+
+// releaseMetrics accumulate the deployments of the classic releases of each project
+type releaseMetrics struct {
+	ledger        *seenLedger
+	results       *counterSet
+	durations     *histogramSet
+	approvalWaits *histogramSet
+}
+
+func newReleaseMetrics(ledgerTTL time.Duration) *releaseMetrics {
+	return &releaseMetrics{
+		ledger:        newSeenLedger(ledgerTTL),
+		results:       newCounterSet(releaseDeploymentsDesc),
+		durations:     newHistogramSet(releaseDeploymentDurationDesc, prometheus.ExponentialBuckets(1, 2, 15)), // 1 second up to ~4.5 hours
+		approvalWaits: newHistogramSet(releaseApprovalWaitDesc, prometheus.ExponentialBuckets(60, 2, 12)),      // 1 minute up to ~34 hours
+	}
+}
+
+// Observe accounts for the finished deployments of a project that haven't been seen yet. The deployments
+// returned by the first poll of a project finished before the exporter started, so they only seed the ledger.
+func (rm *releaseMetrics) Observe(project azdo.Project, deployments []azdo.Deployment, now time.Time) {
+	firstPoll := rm.ledger.firstPoll(project.Name)
+
+	for _, deployment := range deployments {
+		if deployment.CompletedOn.IsZero() || deployment.DeploymentStatus == "inProgress" {
+			continue
+		}
+
+		if !rm.ledger.admitOnce(project.Name, deployment.Id, deployment.CompletedOn, now) || firstPoll {
+			continue
+		}
+
+		labelValues := []string{project.Name, deployment.ReleaseDefinition.Name, deployment.ReleaseEnvironment.Name}
+		rm.results.Add(1, append(labelValues, deployment.DeploymentStatus)...)
+
+		// Deployments rejected or cancelled before they started have no start time
+		if !deployment.StartedOn.IsZero() {
+			rm.durations.Observe(deployment.CompletedOn.Sub(deployment.StartedOn).Seconds(), labelValues...)
+		}
+
+		approvals := append(append([]azdo.ReleaseApproval{}, deployment.PreDeployApprovals...), deployment.PostDeployApprovals...)
+		for _, approval := range approvals {
+			if approval.IsAutomated || (approval.Status != "approved" && approval.Status != "rejected") {
+				continue
+			}
+			rm.approvalWaits.Observe(approval.ModifiedOn.Sub(approval.CreatedOn).Seconds(), labelValues...)
+		}
+	}
+}
+
+func (rm *releaseMetrics) Collect(ch chan<- prometheus.Metric) {
+	rm.results.Collect(ch)
+	rm.durations.Collect(ch)
+	rm.approvalWaits.Collect(ch)
+}
+
+// scrapeReleases retrieves the most recent deployments and the pending approvals of the classic releases of each project
+func (azc *azDoCollector) scrapeReleases(ctx context.Context, projects []azdo.Project) []prometheus.Metric {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	metrics := []prometheus.Metric{}
+
+	for _, project := range projects {
+		p := project
+
+		wg.Add(1)
+		azc.pool.submit(p.Name, func() {
+			defer wg.Done()
+
+			deployments, err := azc.AzDoClient.GetDeployments(ctx, p.Name, releaseDeploymentCount)
+			if err != nil {
+				azc.recordError(p.Name, err)
+				return
+			}
+			azc.releases.Observe(p, deployments, time.Now())
+		})
+
+		wg.Add(1)
+		azc.pool.submit(p.Name, func() {
+			defer wg.Done()
+
+			approvals, err := azc.AzDoClient.GetPendingApprovals(ctx, p.Name)
+			if err != nil {
+				azc.recordError(p.Name, err)
+				return
+			}
+
+			approvalMetrics := calculatePendingApprovalMetrics(p, approvals, time.Now())
+
+			lock.Lock()
+			metrics = append(metrics, approvalMetrics...)
+			lock.Unlock()
+		})
+	}
+
+	wg.Wait()
+	return metrics
+}
+
+// calculatePendingApprovalMetrics counts the approvals waiting for someone, and how long the oldest has waited,
+// for each release definition and environment
+func calculatePendingApprovalMetrics(project azdo.Project, approvals []azdo.ReleaseApproval, now time.Time) []prometheus.Metric {
+	type pending struct {
+		definition  string
+		environment string
+		count       int
+		oldest      time.Time
+	}
+
+	byEnvironment := make(map[string]*pending)
+	for _, approval := range approvals {
+		if approval.IsAutomated {
+			continue
+		}
+
+		key := labelKey([]string{approval.ReleaseDefinition.Name, approval.ReleaseEnvironment.Name})
+		p, ok := byEnvironment[key]
+		if !ok {
+			p = &pending{definition: approval.ReleaseDefinition.Name, environment: approval.ReleaseEnvironment.Name}
+			byEnvironment[key] = p
+		}
+		p.count++
+		if p.oldest.IsZero() || approval.CreatedOn.Before(p.oldest) {
+			p.oldest = approval.CreatedOn
+		}
+	}
+
+	keys := make([]string, 0, len(byEnvironment))
+	for key := range byEnvironment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	promMetrics := []prometheus.Metric{}
+	for _, key := range keys {
+		p := byEnvironment[key]
+		promMetrics = append(promMetrics,
+			prometheus.MustNewConstMetric(releasePendingApprovalsDesc, prometheus.GaugeValue, float64(p.count), project.Name, p.definition, p.environment),
+			prometheus.MustNewConstMetric(releaseOldestPendingApprovalDesc, prometheus.GaugeValue, now.Sub(p.oldest).Seconds(), project.Name, p.definition, p.environment),
+		)
+	}
+	return promMetrics
+}
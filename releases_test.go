@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestReleaseMetricsFirstPoll(t *testing.T) {
+	project := azdo.Project{Name: "project"}
+	deployment := func(id int, completed time.Duration) azdo.Deployment {
+		return azdo.Deployment{
+			Id:                 id,
+			ReleaseDefinition:  azdo.ReleaseReference{Name: "release"},
+			ReleaseEnvironment: azdo.ReleaseReference{Name: "production"},
+			DeploymentStatus:   "succeeded",
+			StartedOn:          ledgerStart,
+			CompletedOn:        ledgerStart.Add(completed),
+			PreDeployApprovals: []azdo.ReleaseApproval{{Status: "approved", CreatedOn: ledgerStart, ModifiedOn: ledgerStart.Add(time.Minute)}},
+		}
+	}
+	observed := func(rm *releaseMetrics) (float64, uint64, uint64) {
+		deployments := 0.0
+		for _, value := range rm.results.snapshot() {
+			deployments += value.Value
+		}
+		durations, approvals := uint64(0), uint64(0)
+		for _, value := range rm.durations.snapshot() {
+			durations += value.Count
+		}
+		for _, value := range rm.approvalWaits.snapshot() {
+			approvals += value.Count
+		}
+		return deployments, durations, approvals
+	}
+
+	rm := newReleaseMetrics(2 * time.Hour)
+
+	// The deployments made before the exporter started only seed the ledger
+	deployments := []azdo.Deployment{deployment(2, 2*time.Minute), deployment(1, time.Minute)}
+	rm.Observe(project, deployments, ledgerStart.Add(5*time.Minute))
+	if d, durations, approvals := observed(rm); d != 0 || durations != 0 || approvals != 0 {
+		t.Errorf("first poll observed %v deployments, %d durations and %d approval waits, want none", d, durations, approvals)
+	}
+
+	// Only the deployment made since is observed by the next poll
+	deployments = append([]azdo.Deployment{deployment(3, 6*time.Minute)}, deployments...)
+	rm.Observe(project, deployments, ledgerStart.Add(10*time.Minute))
+	if d, durations, approvals := observed(rm); d != 1 || durations != 1 || approvals != 1 {
+		t.Errorf("second poll observed %v deployments, %d durations and %d approval waits, want 1 of each", d, durations, approvals)
+	}
+}
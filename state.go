@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var stateKey = []byte("state")
+
+// collectorState is everything a collector needs to carry on after a restart without gaps or double counting
+type collectorState struct {
+	SavedAt    time.Time
+	Watermarks map[string]time.Time
+	Ledgers    map[string]map[string]map[int]ledgerEntry // By the name of the ledger
+	Counters   map[string][]*counterValue
+	Histograms map[string][]*histogramValue
+	Failing    map[string]time.Time // When production deployments of each pipeline started failing
+	Shipped    map[string]int       // The last run of each pipeline deployed to production
+	FollowUps  []pendingFollowUp    // Finished builds still to be followed up
+}
+
+// stateStore persists the state of each collector to a single local bolt database file, one bucket per server
+type stateStore struct {
+	db *bolt.DB
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) close() error {
+	return s.db.Close()
+}
+
+// load returns the state saved for the server, returning false if there is none
+func (s *stateStore) load(server string) (collectorState, bool, error) {
+	var state collectorState
+	found := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(server))
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get(stateKey)
+		if data == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(data, &state)
+	})
+
+	return state, found, err
+}
+
+// save replaces the state saved for the server
+func (s *stateStore) save(server string, state collectorState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(server))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(stateKey, data)
+	})
+}
+
+// ledgers are the ledgers of the collector, by the name they are saved under
+func (azc *azDoCollector) ledgers() map[string]*seenLedger {
+	return map[string]*seenLedger{
+		"builds":              azc.ledger,
+		"job_requests":        azc.jobRequestLedger,
+		"deployments":         azc.environments.ledger,
+		"release_deployments": azc.releases.ledger,
+		"dora_runs":           azc.dora.shipped,
+	}
+}
+
+// counterSets are the cumulative counters of the collector, by the name they are saved under
+func (azc *azDoCollector) counterSets() map[string]*counterSet {
+	sets := map[string]*counterSet{
+		"build_results":           azc.buildResults,
+		"task_failures":           azc.timeline.taskFailures,
+		"task_failures_by_task":   azc.timeline.taskFailuresByTask,
+		"agent_job_results":       azc.agentJobs.results,
+		"environment_deployments": azc.environments.results,
+		"release_deployments":     azc.releases.results,
+		"dora_deployments":        azc.dora.deployments,
+		"test_results":            azc.tests.results,
+	}
+	for name, results := range azc.timeline.results {
+		sets[name+"_results"] = results
+	}
+	return sets
+}
+
+// histogramSets are the cumulative histograms of the collector, by the name they are saved under
+func (azc *azDoCollector) histogramSets() map[string]*histogramSet {
+	sets := map[string]*histogramSet{
+		"build_total_length":          azc.buildDurations.totalTimes,
+		"build_queue_length":          azc.buildDurations.queueTimes,
+		"build_running_length":        azc.buildDurations.jobTimes,
+		"job_wait":                    azc.jobWaitTimes,
+		"deployment_duration":         azc.environments.durations,
+		"release_deployment_duration": azc.releases.durations,
+		"release_approval_wait":       azc.releases.approvalWaits,
+		"dora_lead_time":              azc.dora.leadTimes,
+		"dora_time_to_restore":        azc.dora.restoreTimes,
+		"test_run_duration":           azc.tests.durations,
+	}
+	for name, durations := range azc.timeline.durations {
+		sets[name+"_duration"] = durations
+	}
+	return sets
+}
+
+// state returns the state of the collector to be saved
+func (azc *azDoCollector) state() collectorState {
+	state := collectorState{
+		SavedAt:    time.Now(),
+		Watermarks: make(map[string]time.Time),
+		Ledgers:    make(map[string]map[string]map[int]ledgerEntry),
+		Counters:   make(map[string][]*counterValue),
+		Histograms: make(map[string][]*histogramValue),
+	}
+
+	azc.watermarksLock.Lock()
+	for project, watermark := range azc.watermarks {
+		state.Watermarks[project] = watermark
+	}
+	azc.watermarksLock.Unlock()
+
+	for name, ledger := range azc.ledgers() {
+		state.Ledgers[name] = ledger.snapshot()
+	}
+	for name, counters := range azc.counterSets() {
+		state.Counters[name] = counters.snapshot()
+	}
+	for name, histograms := range azc.histogramSets() {
+		state.Histograms[name] = histograms.snapshot()
+	}
+	state.Failing = azc.dora.snapshotFailing()
+	state.Shipped = azc.dora.snapshotShipped()
+	state.FollowUps = azc.followUpQueue.snapshot()
+
+	return state
+}
+
+// restore loads saved state into the collector, it must be called before the collector starts polling
+func (azc *azDoCollector) restore(state collectorState) {
+	azc.watermarksLock.Lock()
+	for project, watermark := range state.Watermarks {
+		azc.watermarks[project] = watermark
+	}
+	azc.watermarksLock.Unlock()
+
+	for name, ledger := range azc.ledgers() {
+		ledger.restore(state.Ledgers[name])
+	}
+
+	for name, counters := range azc.counterSets() {
+		if dropped := counters.restore(state.Counters[name]); dropped != 0 {
+			log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "counter": name, "dropped": dropped}).Warning("Saved counters have different labels and have been dropped")
+		}
+	}
+	for name, histograms := range azc.histogramSets() {
+		if dropped := histograms.restore(state.Histograms[name]); dropped != 0 {
+			log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "histogram": name, "dropped": dropped}).Warning("Saved histograms have different buckets or labels and have been dropped")
+		}
+	}
+
+	azc.dora.restoreFailing(state.Failing)
+	azc.dora.restoreShipped(state.Shipped)
+	azc.followUpQueue.restore(state.FollowUps)
+}
+
+// saveState saves the state of the collector, if it has a store
+func (azc *azDoCollector) saveState() {
+	if azc.store == nil {
+		return
+	}
+
+	if err := azc.store.save(azc.AzDoClient.Name, azc.state()); err != nil {
+		log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "error": err}).Error("Failed to save state")
+		return
+	}
+	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name}).Debug("State saved")
+}
+
+// loadState restores the state of the collector saved by a previous run, if it has a store
+func (azc *azDoCollector) loadState() {
+	if azc.store == nil {
+		return
+	}
+
+	state, found, err := azc.store.load(azc.AzDoClient.Name)
+	if err != nil {
+		log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "error": err}).Error("Failed to load state, starting afresh")
+		return
+	}
+	if !found {
+		log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name}).Info("No saved state, starting afresh")
+		return
+	}
+
+	azc.restore(state)
+	log.WithFields(log.Fields{"serverName": azc.AzDoClient.Name, "savedAt": state.SavedAt}).Info("Restored saved state")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+var (
+	testResultsDesc = prometheus.NewDesc(
+		"azdo_test_results_total",
+		"Total of the tests run by finished builds by outcome",
+		[]string{"project", "definition", "outcome"},
+		nil,
+	)
+
+	testRunDurationDesc = prometheus.NewDesc(
+		"azdo_test_run_duration_seconds",
+		"Duration of the test runs of finished builds",
+		[]string{"project", "definition"},
+		nil,
+	)
+
+	testPassRateDesc = prometheus.NewDesc(
+		"azdo_test_pass_rate",
+		"Ratio of the tests of the last finished build of the definition with tests that passed, skipped tests count as not passed",
+		[]string{"project", "definition"},
+		nil,
+	)
+)
+
+// The outcome each outcome of a test is counted as, outcomes not listed are counted as other
+var testOutcomes = map[string]string{
+	"Passed":        "passed",
+	"Failed":        "failed",
+	"Aborted":       "failed",
+	"Error":         "failed",
+	"Timeout":       "failed",
+	"NotExecuted":   "skipped",
+	"NotApplicable": "skipped",
+	"NotRunnable":   "skipped",
+}
+
+// testMetrics accumulate the outcomes of the tests run by finished builds
+type testMetrics struct {
+	results   *counterSet
+	durations *histogramSet
+
+	// passRates holds the pass rate of the last build of each definition with tests, by labelKey of project and definition
+	lock      sync.Mutex
+	passRates map[string]passRate
+}
+
+type passRate struct {
+	LabelValues []string
+	Rate        float64
+	FinishTime  time.Time // Of the build the rate is of
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		results:   newCounterSet(testResultsDesc),
+		durations: newHistogramSet(testRunDurationDesc, prometheus.ExponentialBuckets(1, 2, 14)), // 1 second up to ~2.3 hours
+		passRates: make(map[string]passRate),
+	}
+}
+
+// Observe accumulates the test runs of a finished build
+func (tm *testMetrics) Observe(project azdo.Project, build azdo.Build, runs []azdo.TestRun) {
+	labelValues := []string{project.Name, build.Definition.Name}
+
+	outcomes := make(map[string]int)
+	total := 0
+	for _, run := range runs {
+		for outcome, count := range testRunOutcomes(run) {
+			outcomes[outcome] += count
+			total += count
+		}
+
+		if !run.StartedDate.IsZero() && !run.CompletedDate.IsZero() {
+			tm.durations.Observe(run.CompletedDate.Sub(run.StartedDate).Seconds(), labelValues...)
+		}
+	}
+
+	// Builds that don't run tests leave the pass rate of the last build that did
+	if total == 0 {
+		return
+	}
+
+	for outcome, count := range outcomes {
+		tm.results.Add(float64(count), project.Name, build.Definition.Name, outcome)
+	}
+
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	// The test runs of builds are retrieved at once, so an older build can finish being observed last
+	key := labelKey(labelValues)
+	if last, ok := tm.passRates[key]; ok && last.FinishTime.After(build.FinishTime) {
+		return
+	}
+	tm.passRates[key] = passRate{LabelValues: labelValues, Rate: float64(outcomes["passed"]) / float64(total), FinishTime: build.FinishTime}
+}
+
+// testRunOutcomes counts the tests of a run by outcome, from its statistics if it has them
+func testRunOutcomes(run azdo.TestRun) map[string]int {
+	outcomes := make(map[string]int)
+
+	if len(run.RunStatistics) == 0 {
+		outcomes["passed"] = run.PassedTests
+		outcomes["failed"] = run.UnanalyzedTests
+		outcomes["skipped"] = run.NotApplicableTests
+		outcomes["other"] = run.TotalTests - run.PassedTests - run.UnanalyzedTests - run.NotApplicableTests
+		for outcome, count := range outcomes {
+			if count <= 0 {
+				delete(outcomes, outcome)
+			}
+		}
+		return outcomes
+	}
+
+	for _, statistic := range run.RunStatistics {
+		outcome, ok := testOutcomes[statistic.Outcome]
+		if !ok {
+			outcome = "other"
+		}
+		outcomes[outcome] += statistic.Count
+	}
+	return outcomes
+}
+
+func (tm *testMetrics) Collect(ch chan<- prometheus.Metric) {
+	tm.results.Collect(ch)
+	tm.durations.Collect(ch)
+
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	keys := make([]string, 0, len(tm.passRates))
+	for key := range tm.passRates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rate := tm.passRates[key]
+		ch <- prometheus.MustNewConstMetric(testPassRateDesc, prometheus.GaugeValue, rate.Rate, rate.LabelValues...)
+	}
+}
+
+// followUpTests retrieves the test runs of a newly finished build, and the results of its tests when
+// flaky tests are flagged. Everything is retrieved before anything is observed, so a build followed up
+// again after a request failed isn't counted twice.
+func (azc *azDoCollector) followUpTests(ctx context.Context, project azdo.Project, build azdo.Build) error {
+	runs, err := azc.AzDoClient.GetTestRuns(ctx, project.Name, build.Id)
+	if err != nil {
+		azc.recordError(project.Name, err)
+		return err
+	}
+
+	var failed, passed []string
+	if azc.flakyTests != nil {
+		if failed, passed, err = azc.flakyTestResults(ctx, project, build, runs); err != nil {
+			return err
+		}
+	}
+
+	azc.tests.Observe(project, build, runs)
+
+	if azc.flakyTests != nil {
+		azc.flakyTests.observeMarked(project, build, runs)
+		azc.flakyTests.Observe(project, build, failed, passed, time.Now())
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+// The timeline record types durations and results are collected for, and the name used for them in metrics
+var timelineRecordTypes = map[string]string{
+	"Stage": "stage",
+	"Job":   "job",
+	"Task":  "task",
+}
+
+var (
+	taskFailuresDesc = prometheus.NewDesc(
+		"azdo_task_failures_total",
+		"Total of failed tasks of finished builds",
+		[]string{"project", "definition", "task_name", "task_version"},
+		nil,
+	)
+
+	taskFailuresByTaskDesc = prometheus.NewDesc(
+		"azdo_task_failures_by_task_total",
+		"Total of failed tasks of finished builds across every project, by task",
+		[]string{"task_id", "task_name", "task_version"},
+		nil,
+	)
+)
+
+// timelineMetrics accumulate the durations and results of the stages, jobs and tasks of finished builds
+// across polls, for the definitions in the allowlist. The failed tasks of every failed build are
+// attributed to the task that was run, if that is turned on.
+type timelineMetrics struct {
+	definitions map[int]bool
+	durations   map[string]*histogramSet // By record type
+	results     map[string]*counterSet   // By record type
+
+	attributeFailures  bool
+	taskFailures       *counterSet
+	taskFailuresByTask *counterSet
+}
+
+func newTimelineMetrics(definitions []int, attributeFailures bool) *timelineMetrics {
+	tm := &timelineMetrics{
+		definitions: make(map[int]bool, len(definitions)),
+		durations:   make(map[string]*histogramSet),
+		results:     make(map[string]*counterSet),
+
+		attributeFailures:  attributeFailures,
+		taskFailures:       newCounterSet(taskFailuresDesc),
+		taskFailuresByTask: newCounterSet(taskFailuresByTaskDesc),
+	}
+
+	for _, id := range definitions {
+		tm.definitions[id] = true
+	}
+
+	for _, name := range timelineRecordTypes {
+		tm.durations[name] = newHistogramSet(prometheus.NewDesc(
+			"azdo_build_"+name+"_duration_seconds",
+			"Duration of the "+name+"s of finished builds",
+			[]string{"project", "definition", name},
+			nil,
+		), prometheus.ExponentialBuckets(1, 2, 15)) // 1 second up to ~4.5 hours
+
+		tm.results[name] = newCounterSet(prometheus.NewDesc(
+			"azdo_build_"+name+"_results_total",
+			"Total of the "+name+"s of finished builds by result",
+			[]string{"project", "definition", name, "result"},
+			nil,
+		))
+	}
+
+	return tm
+}
+
+// wants reports if the timeline of the build should be retrieved
+func (tm *timelineMetrics) wants(build azdo.Build) bool {
+	return tm.definitions[build.Definition.Id] || tm.wantsFailures(build)
+}
+
+// wantsFailures reports if the failed tasks of the build should be attributed
+func (tm *timelineMetrics) wantsFailures(build azdo.Build) bool {
+	return tm.attributeFailures && build.Result == "failed"
+}
+
+// Observe accumulates the stages, jobs and tasks of the timeline of a finished build
+func (tm *timelineMetrics) Observe(project azdo.Project, build azdo.Build, timeline azdo.Timeline) {
+	durations := tm.definitions[build.Definition.Id]
+	failures := tm.wantsFailures(build)
+
+	for _, record := range timeline.Records {
+		name, ok := timelineRecordTypes[record.Type]
+		if !ok || record.Result == "" {
+			continue
+		}
+
+		// Attribute failures to the task that was run, so a bad release of a task shows up wherever it is used
+		if failures && record.Result == "failed" && record.Task != nil {
+			tm.taskFailures.Add(1, project.Name, build.Definition.Name, record.Task.Name, record.Task.Version)
+			tm.taskFailuresByTask.Add(1, record.Task.Id, record.Task.Name, record.Task.Version)
+		}
+
+		if !durations {
+			continue
+		}
+		tm.results[name].Add(1, project.Name, build.Definition.Name, record.Name, record.Result)
+
+		// Skipped records have no start or finish time
+		if record.StartTime.IsZero() || record.FinishTime.IsZero() {
+			continue
+		}
+		tm.durations[name].Observe(record.FinishTime.Sub(record.StartTime).Seconds(), project.Name, build.Definition.Name, record.Name)
+	}
+}
+
+func (tm *timelineMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range timelineRecordTypes {
+		tm.durations[name].Collect(ch)
+		tm.results[name].Collect(ch)
+	}
+	tm.taskFailures.Collect(ch)
+	tm.taskFailuresByTask.Collect(ch)
+}
+
+// followUpTimeline retrieves the timeline of a newly finished build, if its definition is in the allowlist,
+// its failed tasks are to be attributed or its jobs are to be attributed to agents
+func (azc *azDoCollector) followUpTimeline(ctx context.Context, project azdo.Project, build azdo.Build) error {
+	if !azc.timeline.wants(build) && !azc.agentJobs.enabled {
+		return nil
+	}
+
+	timeline, err := azc.AzDoClient.GetTimeline(ctx, project.Name, build.Id)
+	if err != nil {
+		azc.recordError(project.Name, err)
+		return err
+	}
+
+	var pools map[int]string
+	if azc.agentJobs.enabled {
+		if pools, err = azc.jobPools(ctx, project, build, timeline); err != nil {
+			return err
+		}
+	}
+
+	azc.timeline.Observe(project, build, timeline)
+	if azc.agentJobs.enabled {
+		azc.agentJobs.Observe(build, timeline, pools, time.Now())
+	}
+	return nil
+}
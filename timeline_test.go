@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"ukho.gov.uk/azdo-build-exporter/azdo"
+)
+
+func TestTimelineMetricsObserve(t *testing.T) {
+	timeline := azdo.Timeline{Records: []azdo.TimelineRecord{
+		{Type: "Job", Name: "Build", Result: "failed"},
+		{Type: "Task", Name: "Restore", Result: "failed", Task: &azdo.TaskReference{Id: "333b11bd", Name: "NuGetCommand", Version: "2.218.1"}},
+	}}
+
+	tests := []struct {
+		name              string
+		allowlisted       bool
+		attributeFailures bool
+		result            string
+		wantWanted        bool
+		wantResults       int // Records counted by the result counters
+		wantFailures      int // Failed tasks attributed
+	}{
+		{name: "allowlisted", allowlisted: true, result: "failed", wantWanted: true, wantResults: 2},
+		{name: "allowlisted with failures attributed", allowlisted: true, attributeFailures: true, result: "failed", wantWanted: true, wantResults: 2, wantFailures: 1},
+		{name: "failed build of any definition", attributeFailures: true, result: "failed", wantWanted: true, wantFailures: 1},
+		{name: "succeeded build of any definition", attributeFailures: true, result: "succeeded"},
+		{name: "not allowlisted", result: "failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			definitions := []int{}
+			if tt.allowlisted {
+				definitions = append(definitions, 7)
+			}
+			tm := newTimelineMetrics(definitions, tt.attributeFailures)
+			build := azdo.Build{Id: 1, Result: tt.result, Definition: azdo.Definition{Id: 7, Name: "ci"}}
+
+			if got := tm.wants(build); got != tt.wantWanted {
+				t.Errorf("wants returned %v, want %v", got, tt.wantWanted)
+			}
+
+			tm.Observe(azdo.Project{Name: "project"}, build, timeline)
+
+			results := 0
+			for _, counters := range tm.results {
+				for _, value := range counters.snapshot() {
+					results += int(value.Value)
+				}
+			}
+			if results != tt.wantResults {
+				t.Errorf("counted %d record results, want %d", results, tt.wantResults)
+			}
+
+			for _, counters := range []*counterSet{tm.taskFailures, tm.taskFailuresByTask} {
+				failures := 0
+				for _, value := range counters.snapshot() {
+					failures += int(value.Value)
+				}
+				if failures != tt.wantFailures {
+					t.Errorf("attributed %d task failures, want %d", failures, tt.wantFailures)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// globalSlots limits the number of tasks running at once across the worker pools of every server.
+// A nil globalSlots doesn't limit them.
+type globalSlots chan struct{}
+
+func newGlobalSlots(size int) globalSlots {
+	if size <= 0 {
+		return nil
+	}
+	return make(globalSlots, size)
+}
+
+func (g globalSlots) acquire() {
+	if g != nil {
+		g <- struct{}{}
+	}
+}
+
+func (g globalSlots) release() {
+	if g != nil {
+		<-g
+	}
+}
+
+// workerPool runs the tasks of a server on a fixed number of workers. Tasks are queued by key
+// (the project) and the queues are served in turn, so one project with many tasks doesn't hold
+// up the others.
+type workerPool struct {
+	size   int
+	global globalSlots
+
+	lock    sync.Mutex
+	ready   *sync.Cond
+	queues  map[string][]queuedTask
+	keys    []string // Keys with queued tasks, in the order they are served
+	next    int
+	stopped bool
+	workers int // Workers that are running
+
+	queued   prometheus.Gauge
+	inFlight prometheus.Gauge
+	waited   prometheus.Histogram
+}
+
+type queuedTask struct {
+	run      func()
+	queuedAt time.Time
+}
+
+func newWorkerPool(size int, global globalSlots) *workerPool {
+	pool := &workerPool{
+		size:   size,
+		global: global,
+		queues: make(map[string][]queuedTask),
+		queued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "azdo_worker_pool_queued_tasks",
+			Help: "Number of tasks waiting for a worker",
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "azdo_worker_pool_in_flight_tasks",
+			Help: "Number of tasks being run by a worker",
+		}),
+		waited: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "azdo_worker_pool_wait_seconds",
+			Help:    "Time tasks waited for a worker",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8), // 10ms up to ~2.7 minutes
+		}),
+	}
+	pool.ready = sync.NewCond(&pool.lock)
+	return pool
+}
+
+// start runs the workers of the pool until the context is done. Tasks queued by then are still
+// run, so nothing waiting on them is left stranded, and the workers stop once there are none left.
+func (p *workerPool) start(ctx context.Context) {
+	p.lock.Lock()
+	p.workers += p.size
+	p.lock.Unlock()
+
+	for i := 0; i < p.size; i++ {
+		go p.work()
+	}
+
+	context.AfterFunc(ctx, func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.stopped = true
+		p.ready.Broadcast()
+	})
+}
+
+// submit queues the task to be run under the key
+func (p *workerPool) submit(key string, task func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.queues[key]) == 0 {
+		p.keys = append(p.keys, key)
+	}
+	p.queues[key] = append(p.queues[key], queuedTask{run: task, queuedAt: time.Now()})
+	p.queued.Inc()
+	p.ready.Signal()
+
+	// Once stopped, a worker is only started again to run the tasks still being submitted
+	if p.stopped && p.workers == 0 {
+		p.workers++
+		go p.work()
+	}
+}
+
+// take waits for a task, taking it from the next key in turn. It returns false once the pool
+// has been stopped and there are no tasks left.
+func (p *workerPool) take() (queuedTask, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.keys) == 0 {
+		if p.stopped {
+			p.workers--
+			return queuedTask{}, false
+		}
+		p.ready.Wait()
+	}
+
+	if p.next >= len(p.keys) {
+		p.next = 0
+	}
+	key := p.keys[p.next]
+
+	task := p.queues[key][0]
+	p.queues[key] = p.queues[key][1:]
+	if len(p.queues[key]) == 0 {
+		delete(p.queues, key)
+		p.keys = append(p.keys[:p.next], p.keys[p.next+1:]...)
+	} else {
+		p.next++
+	}
+
+	p.queued.Dec()
+	return task, true
+}
+
+func (p *workerPool) work() {
+	for {
+		task, ok := p.take()
+		if !ok {
+			return
+		}
+
+		p.global.acquire()
+		p.waited.Observe(time.Since(task.queuedAt).Seconds())
+		p.inFlight.Inc()
+
+		task.run()
+
+		p.inFlight.Dec()
+		p.global.release()
+	}
+}
+
+func (p *workerPool) Collect(ch chan<- prometheus.Metric) {
+	p.queued.Collect(ch)
+	p.inFlight.Collect(ch)
+	p.waited.Collect(ch)
+}
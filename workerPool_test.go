@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolServesKeysInTurn(t *testing.T) {
+	pool := newWorkerPool(1, nil)
+
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+
+	// Queued before the single worker starts, so the order they run in is only down to the turns
+	for _, task := range []struct{ key, name string }{
+		{"a", "a1"}, {"a", "a2"}, {"a", "a3"},
+		{"b", "b1"}, {"b", "b2"},
+		{"c", "c1"},
+	} {
+		wg.Add(1)
+		name := task.name
+		pool.submit(task.key, func() {
+			defer wg.Done()
+			lock.Lock()
+			order = append(order, name)
+			lock.Unlock()
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.start(ctx)
+	wg.Wait()
+
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3"}
+	if len(order) != len(want) {
+		t.Fatalf("ran %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("ran %v, want %v", order, want)
+		}
+	}
+}
+
+func TestWorkerPoolNestedSubmit(t *testing.T) {
+	pool := newWorkerPool(1, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.start(ctx)
+
+	// A task queuing more work behind the other keys, as a project queues the follow ups of its builds
+	var ran atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(1)
+	pool.submit("a", func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			pool.submit("a", func() {
+				defer wg.Done()
+				ran.Add(1)
+			})
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested tasks didn't run with a single worker")
+	}
+	if got := ran.Load(); got != 3 {
+		t.Errorf("ran %d nested tasks, want 3", got)
+	}
+}
+
+func TestWorkerPoolGlobalLimit(t *testing.T) {
+	global := newGlobalSlots(2)
+	pools := []*workerPool{newWorkerPool(3, global), newWorkerPool(3, global)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, pool := range pools {
+		pool.start(ctx)
+	}
+
+	var running, most atomic.Int32
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			wg.Add(1)
+			pool.submit(key, func() {
+				defer wg.Done()
+				now := running.Add(1)
+				for {
+					seen := most.Load()
+					if now <= seen || most.CompareAndSwap(seen, now) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				running.Add(-1)
+			})
+		}
+	}
+	wg.Wait()
+
+	if got := most.Load(); got > 2 {
+		t.Errorf("%d tasks ran at once, want at most 2", got)
+	}
+}
+
+func TestWorkerPoolStopsWithContext(t *testing.T) {
+	pool := newWorkerPool(4, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.start(ctx)
+
+	cancel()
+	waitForWorkers(t, pool, 0)
+
+	// Tasks submitted once stopped are still run, so nothing waiting on them is stranded
+	done := make(chan struct{})
+	pool.submit("a", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task submitted after the pool stopped didn't run")
+	}
+	waitForWorkers(t, pool, 0)
+}
+
+func waitForWorkers(t *testing.T, pool *workerPool, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.lock.Lock()
+		workers := pool.workers
+		pool.lock.Unlock()
+
+		if workers == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d workers, want %d", workers, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}